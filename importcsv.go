@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/clementnuss/truckflow-user-importer/internal/config"
+	"github.com/clementnuss/truckflow-user-importer/internal/failure"
+	"github.com/clementnuss/truckflow-user-importer/internal/payrexx"
+	"github.com/clementnuss/truckflow-user-importer/internal/webhook"
+)
+
+// importCSV backfills the transactions of a Payrexx CSV export.
+func importCSV(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("import-csv", flag.ContinueOnError)
+	productName := fs.String("product", "", "name or SKU of the catalog product bought in the export (default: the first catalog product)")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: import-csv [-product name] export.csv")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return fmt.Errorf("exactly one CSV file must be given")
+	}
+
+	f, err := os.Open(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	rows, err := payrexx.ParseCSV(f)
+	if err != nil {
+		return fmt.Errorf("unable to parse CSV export: %v", err)
+	}
+
+	db, importer, err := setup(ctx)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	product, err := csvProduct(importer.Config, *productName)
+	if err != nil {
+		return err
+	}
+
+	uuids, err := importer.TransactionUUIDs()
+	if err != nil {
+		return err
+	}
+
+	created, skipped, rejected, failed := 0, 0, 0, 0
+	for i, row := range rows {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		line := i + 2 // header and 1-based numbering
+		tr, err := row.Transaction(product, importer.IsBadge)
+		if uuid, ok := uuids[tr.ID]; ok {
+			tr.Uuid = uuid
+		}
+		if tr.Status != payrexx.StatusConfirmed {
+			skipped += 1
+			fmt.Printf("line %d (transaction %s): skipped, status %q\n", line, tr.Uuid, tr.Status)
+			continue
+		}
+		if err != nil {
+			rejected += 1
+			fmt.Printf("line %d (transaction %s): rejected, %v\n", line, tr.Uuid, err)
+			continue
+		}
+
+		out, err := importer.ImportTransaction(ctx, tr, webhook.ImportOptions{})
+		switch {
+		case err != nil && webhook.ErrorKind(err) == failure.Permanent:
+			rejected += 1
+			fmt.Printf("line %d (transaction %s): rejected, %v\n", line, tr.Uuid, err)
+		case err != nil:
+			failed += 1
+			fmt.Printf("line %d (transaction %s): failed, %v\n", line, tr.Uuid, err)
+		case out.AlreadyProcessed:
+			skipped += 1
+			fmt.Printf("line %d (transaction %s): skipped, already processed\n", line, tr.Uuid)
+		default:
+			created += 1
+			fmt.Printf("line %d (transaction %s): created tiers %s, passes %v\n", line, tr.Uuid, out.TiersCode, out.ParkCodes)
+			for _, w := range out.Warnings {
+				fmt.Printf("line %d (transaction %s): warning, %s\n", line, tr.Uuid, w)
+			}
+		}
+	}
+	fmt.Printf("%d rows: %d created, %d skipped, %d rejected, %d failed\n", len(rows), created, skipped, rejected, failed)
+
+	// imported rows are skipped, the export can be imported again
+	if failed > 0 {
+		return fmt.Errorf("%d rows failed, import the export again to retry them", failed)
+	}
+	if rejected > 0 {
+		return fmt.Errorf("%d rows rejected", rejected)
+	}
+	return nil
+}
+
+// csvProduct picks the catalog product the rows of the export are about.
+func csvProduct(cfg *config.Config, name string) (payrexx.Product, error) {
+	if name == "" {
+		p := cfg.Products[0]
+		return payrexx.Product{Name: p.Name, SKU: p.SKU}, nil
+	}
+	for _, p := range cfg.Products {
+		if p.Name == name || (p.SKU != "" && p.SKU == name) {
+			return payrexx.Product{Name: p.Name, SKU: p.SKU}, nil
+		}
+	}
+	return payrexx.Product{}, fmt.Errorf("product %q is not in the catalog", name)
+}
@@ -0,0 +1,144 @@
+package clienthash
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Hasher derives the client hash identifying a customer from their email, so
+// that emails are never stored.
+//
+// Hashes are keyed, e.g. k2:1f0c..., so that they cannot be reversed by
+// hashing a list of known emails. Without any key, the Hasher falls back to
+// the legacy unkeyed hash of the raw email.
+type Hasher struct {
+	// Keys are the HMAC keys. The first one hashes the customers, the
+	// others are previous keys whose hashes are still recognized until the
+	// records are rewritten, see the rehash command.
+	Keys []Key
+	// StripPlus drops the +tag of the local part of the emails, so that
+	// foo+badge@mail.ch is the same customer as foo@mail.ch.
+	StripPlus bool
+}
+
+// Key is an HMAC key, identified in the hashes it produces by its ID.
+type Key struct {
+	ID     string
+	Secret []byte
+}
+
+var keyID = regexp.MustCompile(`^[a-zA-Z0-9]{1,16}$`)
+
+// FromEnv configures the Hasher from CLIENT_HASH_KEYS, a comma separated list
+// of id:secret keys, the current one first, and CLIENT_HASH_STRIP_PLUS.
+func FromEnv() (*Hasher, error) {
+	h := &Hasher{}
+	if v := os.Getenv("CLIENT_HASH_STRIP_PLUS"); v != "" {
+		strip, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CLIENT_HASH_STRIP_PLUS %q", v)
+		}
+		h.StripPlus = strip
+	}
+
+	if v := os.Getenv("CLIENT_HASH_KEYS"); v != "" {
+		for _, k := range strings.Split(v, ",") {
+			id, secret, _ := strings.Cut(strings.TrimSpace(k), ":")
+			h.Keys = append(h.Keys, Key{ID: id, Secret: []byte(secret)})
+		}
+	}
+	if err := h.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid CLIENT_HASH_KEYS: %v", err)
+	}
+	return h, nil
+}
+
+// Validate makes sure the keys are usable.
+func (h *Hasher) Validate() error {
+	seen := map[string]bool{}
+	for i, k := range h.Keys {
+		if !keyID.MatchString(k.ID) {
+			return fmt.Errorf("key %d: the id must be 1 to 16 letters or digits", i)
+		}
+		if len(k.Secret) < 16 {
+			return fmt.Errorf("key %s: the secret must be at least 16 bytes long", k.ID)
+		}
+		if seen[k.ID] {
+			return fmt.Errorf("key %s: duplicate id", k.ID)
+		}
+		seen[k.ID] = true
+	}
+	return nil
+}
+
+// Keyed reports whether the hashes are keyed. The legacy hash is used
+// otherwise.
+func (h *Hasher) Keyed() bool {
+	return len(h.Keys) > 0
+}
+
+// Hash returns the client hash of the email, with the current key.
+func (h *Hasher) Hash(email string) string {
+	if !h.Keyed() {
+		return Legacy(email)
+	}
+	return h.keyed(h.Keys[0], email)
+}
+
+// Candidates returns every hash the customer may still be recorded with: the
+// current hash first, then the hashes with the previous keys and the legacy
+// hash.
+func (h *Hasher) Candidates(email string) []string {
+	hashes := []string{h.Hash(email)}
+	if !h.Keyed() {
+		return hashes
+	}
+	for _, k := range h.Keys[1:] {
+		hashes = append(hashes, h.keyed(k, email))
+	}
+	return append(hashes, Legacy(email))
+}
+
+// IsCurrent reports whether hash was made with the current key.
+func (h *Hasher) IsCurrent(hash string) bool {
+	if !h.Keyed() {
+		return !strings.Contains(hash, ":")
+	}
+	return strings.HasPrefix(hash, h.Keys[0].ID+":")
+}
+
+func (h *Hasher) keyed(k Key, email string) string {
+	mac := hmac.New(sha256.New, k.Secret)
+	mac.Write([]byte(Normalize(email, h.StripPlus)))
+	return k.ID + ":" + hex.EncodeToString(mac.Sum(nil)[:16])
+}
+
+// Normalize trims and lowercases the email, and drops the +tag of its local
+// part if stripPlus is set.
+func Normalize(email string, stripPlus bool) string {
+	email = strings.ToLower(strings.TrimSpace(email))
+	if !stripPlus {
+		return email
+	}
+	local, domain, ok := strings.Cut(email, "@")
+	if !ok {
+		return email
+	}
+	if base, _, tagged := strings.Cut(local, "+"); tagged && base != "" {
+		return base + "@" + domain
+	}
+	return email
+}
+
+// Legacy is the hash used before keys were introduced: the truncated SHA-256
+// of the raw email.
+func Legacy(email string) string {
+	sum := sha256.Sum256([]byte(email))
+	return hex.EncodeToString(sum[:8])
+}
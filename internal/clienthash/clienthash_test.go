@@ -0,0 +1,64 @@
+package clienthash
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNormalize(t *testing.T) {
+	for email, want := range map[string]string{
+		" Foo@Mail.ch ":     "foo@mail.ch",
+		"foo+badge@mail.ch": "foo@mail.ch",
+		"+badge@mail.ch":    "+badge@mail.ch",
+		"foo+badge":         "foo+badge",
+	} {
+		assert.Equal(t, want, Normalize(email, true), email)
+	}
+	assert.Equal(t, "foo+badge@mail.ch", Normalize("Foo+Badge@mail.ch", false))
+}
+
+func TestHasher(t *testing.T) {
+	legacy := &Hasher{}
+	assert.Equal(t, "63d36f58d222be24", Legacy("some@email.ch"))
+	assert.Equal(t, Legacy("some@email.ch"), legacy.Hash("some@email.ch"))
+	assert.Equal(t, []string{Legacy("some@email.ch")}, legacy.Candidates("some@email.ch"))
+	assert.True(t, legacy.IsCurrent(Legacy("some@email.ch")))
+
+	h := &Hasher{Keys: []Key{
+		{ID: "k2", Secret: []byte("0123456789abcdef")},
+		{ID: "k1", Secret: []byte("fedcba9876543210")},
+	}}
+	hash := h.Hash("some@email.ch")
+	assert.Regexp(t, `^k2:[0-9a-f]{32}$`, hash)
+	assert.Equal(t, hash, h.Hash(" Some@Email.CH"))
+	assert.NotEqual(t, hash, (&Hasher{Keys: h.Keys[1:]}).Hash("some@email.ch"))
+	assert.True(t, h.IsCurrent(hash))
+
+	candidates := h.Candidates("some@email.ch")
+	require.Len(t, candidates, 3)
+	assert.Equal(t, hash, candidates[0])
+	assert.Equal(t, (&Hasher{Keys: h.Keys[1:]}).Hash("some@email.ch"), candidates[1])
+	assert.Equal(t, Legacy("some@email.ch"), candidates[2])
+	assert.False(t, h.IsCurrent(candidates[1]))
+	assert.False(t, h.IsCurrent(candidates[2]))
+}
+
+func TestFromEnv(t *testing.T) {
+	t.Setenv("CLIENT_HASH_KEYS", "k2:0123456789abcdef, k1:fedcba98:76543210")
+	t.Setenv("CLIENT_HASH_STRIP_PLUS", "true")
+	h, err := FromEnv()
+	require.NoError(t, err)
+	assert.True(t, h.StripPlus)
+	assert.Equal(t, []Key{
+		{ID: "k2", Secret: []byte("0123456789abcdef")},
+		{ID: "k1", Secret: []byte("fedcba98:76543210")},
+	}, h.Keys)
+
+	for _, keys := range []string{"k2", "k2:short", "k-2:0123456789abcdef", "k2:0123456789abcdef,k2:fedcba9876543210"} {
+		t.Setenv("CLIENT_HASH_KEYS", keys)
+		_, err := FromEnv()
+		assert.Error(t, err, keys)
+	}
+}
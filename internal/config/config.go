@@ -0,0 +1,187 @@
+package config
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Config holds the business values of the Truckflow setup the importer feeds.
+type Config struct {
+	Truckflow Truckflow `yaml:"truckflow"`
+	// Products is the catalog of the badges sold on Payrexx.
+	Products []Product `yaml:"products"`
+}
+
+type Truckflow struct {
+	// Version of the Truckflow import format.
+	Version string `yaml:"version"`
+	// Culture of the pass imports.
+	Culture string `yaml:"culture"`
+	// TiersType of the created tiers.
+	TiersType string `yaml:"tiers_type"`
+	// TiersCodeFormat and ParkCodeFormat turn the client and pass counters
+	// into Truckflow codes. They must contain a single integer verb.
+	TiersCodeFormat string `yaml:"tiers_code_format"`
+	ParkCodeFormat  string `yaml:"park_code_format"`
+	// CompanyCodes map the Payrexx client type to a Truckflow company.
+	CompanyCodes CompanyCodes `yaml:"company_codes"`
+}
+
+type CompanyCodes struct {
+	Company    string `yaml:"company"`
+	Individual string `yaml:"individual"`
+}
+
+// Product maps a Payrexx product to the Truckflow passes it grants.
+type Product struct {
+	// Name and SKU identify the Payrexx product. The SKU takes precedence
+	// when it is set.
+	Name string `yaml:"name"`
+	SKU  string `yaml:"sku"`
+	// ProductCode and FlowType of the created passes.
+	ProductCode string `yaml:"product_code"`
+	FlowType    string `yaml:"flow_type"`
+}
+
+// Default returns the configuration of the original Truckflow setup.
+func Default() *Config {
+	return &Config{
+		Truckflow: Truckflow{
+			Version:         "1.50",
+			Culture:         "fr",
+			TiersType:       "Fournisseur",
+			TiersCodeFormat: "%05d",
+			ParkCodeFormat:  "NEW%05d",
+			CompanyCodes: CompanyCodes{
+				Company:    "entreprises",
+				Individual: "particuliers",
+			},
+		},
+		Products: []Product{{
+			Name:        "Badge Ajoverts",
+			ProductCode: "Dechets verts",
+			FlowType:    "Réception",
+		}},
+	}
+}
+
+// Load reads the YAML configuration file at path. Values missing from the
+// file keep their default. An empty path returns the default configuration.
+func Load(path string) (*Config, error) {
+	cfg := Default()
+	if path == "" {
+		return cfg, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read configuration: %v", err)
+	}
+
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(cfg); err != nil {
+		return nil, fmt.Errorf("unable to parse configuration %s: %v", path, err)
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid configuration %s: %v", path, err)
+	}
+	return cfg, nil
+}
+
+// Validate checks that every value is set and that codes can be generated.
+func (c *Config) Validate() error {
+	var errs []error
+	required := map[string]string{
+		"truckflow.version":                  c.Truckflow.Version,
+		"truckflow.tiers_type":               c.Truckflow.TiersType,
+		"truckflow.company_codes.company":    c.Truckflow.CompanyCodes.Company,
+		"truckflow.company_codes.individual": c.Truckflow.CompanyCodes.Individual,
+	}
+	for k, v := range required {
+		if strings.TrimSpace(v) == "" {
+			errs = append(errs, fmt.Errorf("%s must be set", k))
+		}
+	}
+
+	if len(c.Products) == 0 {
+		errs = append(errs, errors.New("products must not be empty"))
+	}
+	seen := map[string]bool{}
+	for i, p := range c.Products {
+		if p.Name == "" && p.SKU == "" {
+			errs = append(errs, fmt.Errorf("products[%d]: name or sku must be set", i))
+		}
+		if strings.TrimSpace(p.ProductCode) == "" || strings.TrimSpace(p.FlowType) == "" {
+			errs = append(errs, fmt.Errorf("products[%d]: product_code and flow_type must be set", i))
+		}
+		key := "name:" + p.Name
+		if p.SKU != "" {
+			key = "sku:" + p.SKU
+		}
+		if seen[key] {
+			errs = append(errs, fmt.Errorf("products[%d]: duplicate product %q", i, key))
+		}
+		seen[key] = true
+	}
+
+	if err := validateCodeFormat(c.Truckflow.TiersCodeFormat); err != nil {
+		errs = append(errs, fmt.Errorf("truckflow.tiers_code_format: %v", err))
+	}
+	if err := validateCodeFormat(c.Truckflow.ParkCodeFormat); err != nil {
+		errs = append(errs, fmt.Errorf("truckflow.park_code_format: %v", err))
+	}
+
+	return errors.Join(errs...)
+}
+
+// codes are stored in VARCHAR(16) columns
+const maxCodeLength = 16
+
+func validateCodeFormat(format string) error {
+	if strings.Count(format, "%")-2*strings.Count(format, "%%") != 1 {
+		return fmt.Errorf("%q must contain a single verb", format)
+	}
+	code := fmt.Sprintf(format, 99999)
+	if strings.Contains(code, "%!") {
+		return fmt.Errorf("%q is not an integer format", format)
+	}
+	if len(code) > maxCodeLength {
+		return fmt.Errorf("%q generates codes longer than %d characters", format, maxCodeLength)
+	}
+	return nil
+}
+
+// TiersCode formats the client counter value as a tiers code.
+func (t *Truckflow) TiersCode(n int) string {
+	return fmt.Sprintf(t.TiersCodeFormat, n)
+}
+
+// ParkCode formats the pass counter value as a park code.
+func (t *Truckflow) ParkCode(n int) string {
+	return fmt.Sprintf(t.ParkCodeFormat, n)
+}
+
+// LookupProduct finds the catalog entry of a Payrexx product, by SKU first,
+// then by name among the entries without SKU.
+func (c *Config) LookupProduct(name, sku string) (Product, bool) {
+	if sku != "" {
+		for _, p := range c.Products {
+			if p.SKU == sku {
+				return p, true
+			}
+		}
+	}
+	for _, p := range c.Products {
+		if p.SKU == "" && p.Name == name {
+			return p, true
+		}
+	}
+	return Product{}, false
+}
@@ -0,0 +1,76 @@
+package config_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/clementnuss/truckflow-user-importer/internal/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExampleMatchesDefault(t *testing.T) {
+	cfg, err := config.Load("../../config.example.yaml")
+	assert.NoError(t, err)
+	assert.Equal(t, config.Default(), cfg)
+	assert.NoError(t, config.Default().Validate())
+}
+
+func TestLoadOverridesDefaults(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	err := os.WriteFile(path, []byte("truckflow:\n  park_code_format: \"P%06d\"\n  company_codes:\n    company: pros\n"), 0o600)
+	assert.NoError(t, err)
+
+	cfg, err := config.Load(path)
+	assert.NoError(t, err)
+	assert.Equal(t, "P000042", cfg.Truckflow.ParkCode(42))
+	assert.Equal(t, "00042", cfg.Truckflow.TiersCode(42))
+	assert.Equal(t, "pros", cfg.Truckflow.CompanyCodes.Company)
+	assert.Equal(t, "particuliers", cfg.Truckflow.CompanyCodes.Individual)
+}
+
+func TestLoadRejectsInvalidConfiguration(t *testing.T) {
+	for name, content := range map[string]string{
+		"no product":        "products: []\n",
+		"no product code":   "products:\n  - name: Badge\n    flow_type: Réception\n",
+		"duplicate product": "products:\n  - {sku: wood, product_code: Bois, flow_type: Réception}\n  - {sku: wood, product_code: Bois, flow_type: Réception}\n",
+		"unknown field":     "truckflow:\n  colour: blue\n",
+		"empty value":       "truckflow:\n  tiers_type: \"\"\n",
+		"no verb":           "truckflow:\n  park_code_format: NEW\n",
+		"two verbs":         "truckflow:\n  park_code_format: \"%d-%d\"\n",
+		"string verb":       "truckflow:\n  tiers_code_format: \"%s\"\n",
+		"code too long":     "truckflow:\n  park_code_format: \"VERYLONGPREFIX%05d\"\n",
+	} {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "config.yaml")
+			assert.NoError(t, os.WriteFile(path, []byte(content), 0o600))
+
+			_, err := config.Load(path)
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestLookupProduct(t *testing.T) {
+	cfg := config.Default()
+	cfg.Products = append(cfg.Products,
+		config.Product{Name: "Badge bois", SKU: "wood", ProductCode: "Bois", FlowType: "Réception"},
+		config.Product{Name: "Badge gravats", ProductCode: "Gravats", FlowType: "Réception"},
+	)
+	assert.NoError(t, cfg.Validate())
+
+	p, ok := cfg.LookupProduct("Badge Ajoverts", "")
+	assert.True(t, ok)
+	assert.Equal(t, "Dechets verts", p.ProductCode)
+
+	p, ok = cfg.LookupProduct("renamed product", "wood")
+	assert.True(t, ok)
+	assert.Equal(t, "Bois", p.ProductCode)
+
+	p, ok = cfg.LookupProduct("Badge gravats", "unknown-sku")
+	assert.True(t, ok)
+	assert.Equal(t, "Gravats", p.ProductCode)
+
+	_, ok = cfg.LookupProduct("Badge bois", "")
+	assert.False(t, ok)
+}
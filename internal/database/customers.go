@@ -0,0 +1,66 @@
+package database
+
+import (
+	"time"
+
+	"github.com/clementnuss/truckflow-user-importer/internal/metrics"
+)
+
+// Customer is a Truckflow tiers created for a Payrexx customer.
+type Customer struct {
+	TiersCode     string    `json:"tiers_code"`
+	ClientHash    string    `json:"client_hash"`
+	Label         string    `json:"label"`
+	ClientType    int       `json:"client_type"`
+	ContactPerson string    `json:"contact_person"`
+	Address       string    `json:"address"`
+	ZIPCode       string    `json:"zip_code"`
+	City          string    `json:"city"`
+	Telephone     string    `json:"telephone"`
+	CreatedAt     time.Time `json:"created_at"`
+	UpdatedAt     time.Time `json:"updated_at"`
+}
+
+func (q sqlQueries) SaveCustomer(c Customer) error {
+	defer metrics.ObserveDBQuery("save_customer", time.Now())
+
+	upsert := q.dialect.upsertSQL("tiers_code",
+		"client_hash", "label", "client_type", "contact_person", "address", "zip_code", "city", "telephone")
+	_, err := q.db.Exec(`
+        INSERT INTO customers (tiers_code, client_hash, label, client_type, contact_person, address, zip_code, city, telephone)
+        VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+        `+upsert+", updated_at = CURRENT_TIMESTAMP",
+		c.TiersCode, c.ClientHash, c.Label, c.ClientType, c.ContactPerson, c.Address, c.ZIPCode, c.City, c.Telephone,
+	)
+	return err
+}
+
+func (q sqlQueries) FindCustomers(clientHash, tiersCode string) ([]Customer, error) {
+	query := `SELECT tiers_code, client_hash, label, client_type, contact_person, address, zip_code, city, telephone, created_at, updated_at
+        FROM customers`
+	arg := clientHash
+	if clientHash != "" {
+		query += " WHERE client_hash = ?"
+	} else {
+		query += " WHERE tiers_code = ?"
+		arg = tiersCode
+	}
+	query += " ORDER BY tiers_code"
+
+	rows, err := q.db.Query(query, arg)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	customers := []Customer{}
+	for rows.Next() {
+		c := Customer{}
+		err := rows.Scan(&c.TiersCode, &c.ClientHash, &c.Label, &c.ClientType, &c.ContactPerson, &c.Address, &c.ZIPCode, &c.City, &c.Telephone, &c.CreatedAt, &c.UpdatedAt)
+		if err != nil {
+			return nil, err
+		}
+		customers = append(customers, c)
+	}
+	return customers, rows.Err()
+}
@@ -1,91 +1,167 @@
 package database
 
 import (
-	"crypto/sha256"
 	"database/sql"
 	"errors"
-	"fmt"
-	"os"
+	"time"
 
+	"github.com/clementnuss/truckflow-user-importer/internal/metrics"
 	_ "github.com/go-sql-driver/mysql"
 )
 
-func InitDB() (*sql.DB, error) {
-	host := os.Getenv("MARIADB_HOST")
-	user := os.Getenv("MARIADB_USER")
-	password := os.Getenv("MARIADB_PASSWORD")
-	database := os.Getenv("MARIADB_DATABASE")
+// DBTX is satisfied by both *sql.DB and *sql.Tx, so that queries can take
+// part in a transaction.
+type DBTX interface {
+	Exec(query string, args ...any) (sql.Result, error)
+	Query(query string, args ...any) (*sql.Rows, error)
+	QueryRow(query string, args ...any) *sql.Row
+}
 
-	dsn := fmt.Sprintf("%s:%s@tcp(%s)/%s", user, password, host, database)
-	db, err := sql.Open("mysql", dsn)
-	if err != nil {
-		return nil, fmt.Errorf("error connecting to database: %v", err)
-	}
+// sqlQueries implements Queries on a database or within a transaction.
+type sqlQueries struct {
+	db      DBTX
+	dialect *dialect
+}
 
-	_, err = db.Exec(`
-        CREATE TABLE IF NOT EXISTS processed_records (
-            id INT AUTO_INCREMENT PRIMARY KEY,
-            transaction_id VARCHAR(32) NOT NULL,
-            client_hash VARCHAR(32) NOT NULL,
-            processed_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
-            UNIQUE KEY unique_transaction (client_hash, transaction_id)
-        )
-    `)
-	if err != nil {
-		return nil, fmt.Errorf("error creating table: %v", err)
+func (q sqlQueries) PeekCounter(counter string) (int, error) {
+	defer metrics.ObserveDBQuery("peek_counter", time.Now())
+
+	var v int
+	err := q.db.QueryRow("SELECT value FROM counters WHERE name = ?", counter).Scan(&v)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, nil
 	}
+	return v, err
+}
+
+func (q sqlQueries) AllocateCounter(counter string, n int) (int, error) {
+	defer metrics.ObserveDBQuery("allocate_counter", time.Now())
+
+	return q.dialect.allocate(q.db, counter, n)
+}
+
+func (q sqlQueries) IsTransactionProcessed(clientHash, transactionID string) (bool, error) {
+	defer metrics.ObserveDBQuery("is_transaction_processed", time.Now())
 
-	_, err = db.Exec(`
-        CREATE TABLE IF NOT EXISTS counters (
-            name varchar(32) NOT NULL PRIMARY KEY,
-            value int(11) NOT NULL
-        )
-    `)
+	var exists bool
+	err := q.db.QueryRow("SELECT EXISTS(SELECT 1 FROM processed_records WHERE client_hash = ? AND transaction_id = ?)",
+		clientHash, transactionID).Scan(&exists)
 	if err != nil {
-		return nil, fmt.Errorf("error creating table: %v", err)
+		return false, err
 	}
-	return db, nil
+	return exists, nil
 }
 
-func RetrieveCounter(db *sql.DB, counter string) (int, error) {
-	var v int
-	err := db.QueryRow("SELECT value FROM counters WHERE name = ?", counter).Scan(&v)
+func (q sqlQueries) RecordProcessedTransaction(clientHash, transactionID, tiersCode string, warnings []byte) error {
+	defer metrics.ObserveDBQuery("record_processed_transaction", time.Now())
 
+	upsert := q.dialect.upsertSQL("client_hash, transaction_id", "tiers_code", "warnings")
+	_, err := q.db.Exec(`
+        INSERT INTO processed_records (client_hash, transaction_id, tiers_code, warnings) VALUES (?, ?, ?, ?)
+        `+upsert+", processed_at = CURRENT_TIMESTAMP, reversed_at = NULL",
+		clientHash, transactionID, tiersCode, warnings,
+	)
+	return err
+}
+
+func (q sqlQueries) CustomerTiersCode(clientHash, code string) (string, error) {
+	defer metrics.ObserveDBQuery("customer_tiers_code", time.Now())
+
+	query := "SELECT tiers_code FROM processed_records WHERE client_hash = ? AND tiers_code != ''"
+	args := []any{clientHash}
+	if code != "" {
+		query += " AND tiers_code = ?"
+		args = append(args, code)
+	}
+	query += " ORDER BY processed_at DESC, id DESC LIMIT 1"
+
+	var tiersCode string
+	err := q.db.QueryRow(query, args...).Scan(&tiersCode)
 	if errors.Is(err, sql.ErrNoRows) {
-		return 0, SetCounter(db, counter, 0)
-	} else if err != nil {
-		return -1, err
+		return "", nil
 	}
+	return tiersCode, err
+}
 
-	return v, nil
+// ProcessedRecord is a transaction that was imported to Truckflow.
+type ProcessedRecord struct {
+	ClientHash    string `json:"client_hash"`
+	TransactionID string `json:"transaction_id"`
+	TiersCode     string `json:"tiers_code"`
+	Reversed      bool   `json:"reversed"`
 }
 
-func SetCounter(db *sql.DB, counter string, value int) error {
-	_, err := db.Exec("REPLACE INTO counters (name, value) VALUES (?, ?);", counter, value)
+func (q sqlQueries) GetProcessedTransaction(clientHash, transactionID string) (*ProcessedRecord, error) {
+	defer metrics.ObserveDBQuery("get_processed_transaction", time.Now())
 
-	return err
+	rec := ProcessedRecord{ClientHash: clientHash, TransactionID: transactionID}
+	err := q.db.QueryRow(
+		"SELECT tiers_code, reversed_at IS NOT NULL FROM processed_records WHERE client_hash = ? AND transaction_id = ?",
+		clientHash, transactionID,
+	).Scan(&rec.TiersCode, &rec.Reversed)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return &rec, nil
 }
 
-func IsTransactionProcessed(db *sql.DB, clientHash, transactionID string) (bool, error) {
-	var exists bool
-	err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM processed_records WHERE client_hash = ? AND transaction_id = ?)",
-		clientHash, transactionID).Scan(&exists)
+func (q sqlQueries) MarkTransactionReversed(clientHash, transactionID string) (bool, error) {
+	res, err := q.db.Exec(
+		"UPDATE processed_records SET reversed_at = CURRENT_TIMESTAMP WHERE client_hash = ? AND transaction_id = ? AND reversed_at IS NULL",
+		clientHash, transactionID,
+	)
 	if err != nil {
 		return false, err
 	}
-	return exists, nil
+	n, err := res.RowsAffected()
+	return n > 0, err
 }
 
-func RecordProcessedTransaction(db *sql.DB, clientHash, transactionID string) error {
-	_, err := db.Exec(
-		"INSERT INTO processed_records (client_hash, transaction_id) VALUES (?, ?)",
-		clientHash, transactionID,
-	)
-	return err
+func (q sqlQueries) ClientHashExists(clientHash string) (bool, error) {
+	defer metrics.ObserveDBQuery("client_hash_exists", time.Now())
+
+	var exists bool
+	err := q.db.QueryRow(`
+        SELECT EXISTS(SELECT 1 FROM processed_records WHERE client_hash = ?)
+            OR EXISTS(SELECT 1 FROM customers WHERE client_hash = ?)`,
+		clientHash, clientHash).Scan(&exists)
+	return exists, err
 }
 
-func GenerateHash(email string) string {
-	hasher := sha256.New()
-	hasher.Write([]byte(email))
-	return fmt.Sprintf("%x", hasher.Sum(nil)[:8])
+func (q sqlQueries) ClientHashes() ([]string, error) {
+	rows, err := q.db.Query("SELECT client_hash FROM processed_records UNION SELECT client_hash FROM customers")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	hashes := []string{}
+	for rows.Next() {
+		var h string
+		if err := rows.Scan(&h); err != nil {
+			return nil, err
+		}
+		hashes = append(hashes, h)
+	}
+	return hashes, rows.Err()
+}
+
+func (q sqlQueries) RehashClient(from, to string) error {
+	// a transaction recorded with both hashes keeps its latest record; the
+	// derived table works around MariaDB refusing to delete from a table
+	// read by a subquery
+	_, err := q.db.Exec(`
+        DELETE FROM processed_records WHERE client_hash = ? AND transaction_id IN (
+            SELECT transaction_id FROM (SELECT transaction_id FROM processed_records WHERE client_hash = ?) AS current
+        )`, from, to)
+	if err != nil {
+		return err
+	}
+	if _, err := q.db.Exec("UPDATE processed_records SET client_hash = ? WHERE client_hash = ?", to, from); err != nil {
+		return err
+	}
+	_, err = q.db.Exec("UPDATE customers SET client_hash = ? WHERE client_hash = ?", to, from)
+	return err
 }
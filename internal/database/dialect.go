@@ -0,0 +1,32 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+// dialect holds what differs between the SQL databases supported.
+type dialect struct {
+	// migrations is the directory of the embedded migrations.
+	migrations string
+	// now is the current time, and secondsFromNow the current time plus the
+	// number of seconds given as parameter.
+	now            string
+	secondsFromNow string
+	// upsertSQL is the clause updating the given columns of a row whose key
+	// already exists, for an INSERT statement.
+	upsertSQL func(key string, columns ...string) string
+	// insertIgnore starts an INSERT statement that skips the rows whose key
+	// already exists.
+	insertIgnore string
+	// allocate implements AllocateCounter.
+	allocate func(db DBTX, counter string, n int) (int, error)
+	// time converts a time to a query parameter.
+	time func(t time.Time) any
+	// lock acquires a named lock for conn and returns the function releasing
+	// it.
+	lock func(ctx context.Context, conn *sql.Conn, name string, timeout time.Duration) (func(), error)
+	// missingTable reports whether err is about a table that does not exist.
+	missingTable func(err error) bool
+}
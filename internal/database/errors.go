@@ -0,0 +1,63 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"net"
+
+	"github.com/clementnuss/truckflow-user-importer/internal/failure"
+	"github.com/go-sql-driver/mysql"
+	"modernc.org/sqlite"
+	sqlite3 "modernc.org/sqlite/lib"
+)
+
+// ErrorKind tells whether a database error is worth retrying: connection
+// problems, lock and deadlock timeouts are transient, while data the schema
+// rejects fails again on every attempt.
+func ErrorKind(err error) failure.Kind {
+	var myErr *mysql.MySQLError
+	if errors.As(err, &myErr) {
+		switch myErr.Number {
+		case 1040, // too many connections
+			1053,                   // server shutdown in progress
+			1205,                   // lock wait timeout
+			1213,                   // deadlock
+			1290,                   // read only, e.g. during a failover
+			2002, 2003, 2006, 2013: // connection lost
+			return failure.Transient
+		case 1048, // column cannot be null
+			1062, // duplicate entry
+			1264, // out of range value
+			1292, // incorrect date value
+			1366, // incorrect string value
+			1406: // data too long
+			return failure.Permanent
+		}
+		return failure.Unknown
+	}
+
+	var liteErr *sqlite.Error
+	if errors.As(err, &liteErr) {
+		switch liteErr.Code() & 0xff {
+		case sqlite3.SQLITE_BUSY, sqlite3.SQLITE_LOCKED, sqlite3.SQLITE_FULL, sqlite3.SQLITE_IOERR:
+			return failure.Transient
+		case sqlite3.SQLITE_CONSTRAINT, sqlite3.SQLITE_TOOBIG, sqlite3.SQLITE_MISMATCH:
+			return failure.Permanent
+		}
+		return failure.Unknown
+	}
+
+	var netErr net.Error
+	switch {
+	case errors.Is(err, ErrLockTimeout),
+		errors.Is(err, driver.ErrBadConn),
+		errors.Is(err, mysql.ErrInvalidConn),
+		errors.Is(err, sql.ErrConnDone),
+		errors.Is(err, context.DeadlineExceeded),
+		errors.As(err, &netErr):
+		return failure.Transient
+	}
+	return failure.Unknown
+}
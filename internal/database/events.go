@@ -0,0 +1,247 @@
+package database
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/clementnuss/truckflow-user-importer/internal/metrics"
+)
+
+const (
+	EventPending    = "pending"
+	EventProcessing = "processing"
+	EventDone       = "done"
+	EventFailed     = "failed"
+	// EventPendingReview events failed validation and wait for an operator
+	// to fix and approve them.
+	EventPendingReview = "pending_review"
+	// EventRejected events can never be imported, e.g. malformed payloads.
+	EventRejected = "rejected"
+)
+
+const eventColumns = "id, transaction_uuid, status, attempts, last_error, payload, received_at, overrides"
+
+// WebhookEvent is a raw webhook payload as received from Payrexx, along with
+// its processing state.
+type WebhookEvent struct {
+	ID              int64
+	TransactionUUID string
+	Status          string
+	Attempts        int
+	LastError       string
+	Payload         []byte
+	ReceivedAt      time.Time
+	// Overrides are the JSON encoded corrections made during a review.
+	Overrides []byte
+}
+
+type scanner interface {
+	Scan(dest ...any) error
+}
+
+func scanWebhookEvent(row scanner) (*WebhookEvent, error) {
+	ev := WebhookEvent{}
+	var lastError sql.NullString
+	err := row.Scan(&ev.ID, &ev.TransactionUUID, &ev.Status, &ev.Attempts, &lastError, &ev.Payload, &ev.ReceivedAt, &ev.Overrides)
+	if err != nil {
+		return nil, err
+	}
+	ev.LastError = lastError.String
+	return &ev, nil
+}
+
+func (s *sqlStore) QueueWebhookEvent(transactionUUID string, payload []byte, lease time.Duration) (*WebhookEvent, bool, error) {
+	defer metrics.ObserveDBQuery("queue_webhook_event", time.Now())
+
+	// the unique payload_hash makes concurrent deliveries store a single
+	// event
+	payloadHash := fmt.Sprintf("%x", sha256.Sum256(payload))
+	res, err := s.db.Exec(`
+        `+s.dialect.insertIgnore+` INTO webhook_events (transaction_uuid, status, attempts, payload, payload_hash, next_attempt_at)
+        VALUES (?, ?, 1, ?, ?, `+s.dialect.secondsFromNow+`)`,
+		transactionUUID, EventProcessing, payload, payloadHash, int(lease.Seconds()),
+	)
+	if err != nil {
+		return nil, false, err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return nil, false, err
+	} else if n == 1 {
+		id, err := res.LastInsertId()
+		if err != nil {
+			return nil, false, err
+		}
+		return &WebhookEvent{
+			ID:              id,
+			TransactionUUID: transactionUUID,
+			Status:          EventProcessing,
+			Attempts:        1,
+			Payload:         payload,
+			ReceivedAt:      time.Now(),
+		}, true, nil
+	}
+
+	var due bool
+	ev := WebhookEvent{}
+	var lastError sql.NullString
+	err = s.db.QueryRow(`
+        SELECT `+eventColumns+`, next_attempt_at <= `+s.dialect.now+`
+        FROM webhook_events
+        WHERE payload_hash = ?`,
+		payloadHash,
+	).Scan(&ev.ID, &ev.TransactionUUID, &ev.Status, &ev.Attempts, &lastError, &ev.Payload, &ev.ReceivedAt, &ev.Overrides, &due)
+	if err != nil {
+		return nil, false, err
+	}
+	ev.LastError = lastError.String
+
+	// a redelivery does not wait for the backoff of a pending event
+	if ev.Status == EventPending || ev.Status == EventFailed || (ev.Status == EventProcessing && due) {
+		claimed, err := s.claimWebhookEvent(&ev, lease)
+		return &ev, claimed, err
+	}
+	return &ev, false, nil
+}
+
+func (s *sqlStore) ClaimWebhookEvent(lease time.Duration) (*WebhookEvent, error) {
+	defer metrics.ObserveDBQuery("claim_webhook_event", time.Now())
+
+	for {
+		ev, err := scanWebhookEvent(s.db.QueryRow(`
+            SELECT `+eventColumns+`
+            FROM webhook_events
+            WHERE status IN (?, ?) AND next_attempt_at <= `+s.dialect.now+`
+            ORDER BY id
+            LIMIT 1`,
+			EventPending, EventProcessing,
+		))
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		} else if err != nil {
+			return nil, err
+		}
+
+		if claimed, err := s.claimWebhookEvent(ev, lease); err != nil {
+			return nil, err
+		} else if claimed {
+			return ev, nil
+		}
+	}
+}
+
+func (s *sqlStore) ReclaimWebhookEvent(ev *WebhookEvent, lease time.Duration) (bool, error) {
+	defer metrics.ObserveDBQuery("claim_webhook_event", time.Now())
+	return s.claimWebhookEvent(ev, lease)
+}
+
+// claimWebhookEvent marks the event as processing for lease. It only succeeds
+// if nobody claimed the event in the meantime, and its lease expired if it was
+// already processing.
+func (s *sqlStore) claimWebhookEvent(ev *WebhookEvent, lease time.Duration) (bool, error) {
+	res, err := s.db.Exec(`
+        UPDATE webhook_events
+        SET status = ?, attempts = attempts + 1, next_attempt_at = `+s.dialect.secondsFromNow+`
+        WHERE id = ? AND status = ? AND attempts = ? AND (status != ? OR next_attempt_at <= `+s.dialect.now+`)`,
+		EventProcessing, int(lease.Seconds()), ev.ID, ev.Status, ev.Attempts, EventProcessing,
+	)
+	if err != nil {
+		return false, err
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		return false, err
+	}
+
+	ev.Status = EventProcessing
+	ev.Attempts += 1
+	return true, nil
+}
+
+func (s *sqlStore) CompleteWebhookEvent(id int64) error {
+	_, err := s.db.Exec("UPDATE webhook_events SET status = ?, last_error = NULL WHERE id = ?", EventDone, id)
+	return err
+}
+
+func (s *sqlStore) RetryWebhookEvent(id int64, cause error, delay time.Duration) error {
+	_, err := s.db.Exec(
+		"UPDATE webhook_events SET status = ?, last_error = ?, next_attempt_at = "+s.dialect.secondsFromNow+" WHERE id = ?",
+		EventPending, cause.Error(), int(delay.Seconds()), id,
+	)
+	return err
+}
+
+func (s *sqlStore) FailWebhookEvent(id int64, cause error) error {
+	_, err := s.db.Exec("UPDATE webhook_events SET status = ?, last_error = ? WHERE id = ?", EventFailed, cause.Error(), id)
+	return err
+}
+
+func (s *sqlStore) RejectWebhookEvent(id int64, cause error) error {
+	_, err := s.db.Exec("UPDATE webhook_events SET status = ?, last_error = ? WHERE id = ?", EventRejected, cause.Error(), id)
+	return err
+}
+
+func (s *sqlStore) ReviewWebhookEvent(id int64, cause error) error {
+	_, err := s.db.Exec("UPDATE webhook_events SET status = ?, last_error = ? WHERE id = ?", EventPendingReview, cause.Error(), id)
+	return err
+}
+
+func (s *sqlStore) SetWebhookEventOverrides(id int64, overrides []byte) error {
+	_, err := s.db.Exec("UPDATE webhook_events SET overrides = ? WHERE id = ?", overrides, id)
+	return err
+}
+
+func (s *sqlStore) GetWebhookEvent(id int64) (*WebhookEvent, error) {
+	ev, err := scanWebhookEvent(s.db.QueryRow("SELECT "+eventColumns+" FROM webhook_events WHERE id = ?", id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	return ev, err
+}
+
+// EventFilter selects webhook events. Zero fields are ignored.
+type EventFilter struct {
+	TransactionUUID string
+	From            time.Time
+	To              time.Time
+	Status          string
+}
+
+func (s *sqlStore) ListWebhookEvents(filter EventFilter) ([]WebhookEvent, error) {
+	query := "SELECT " + eventColumns + " FROM webhook_events WHERE 1 = 1"
+	args := []any{}
+	if filter.TransactionUUID != "" {
+		query += " AND transaction_uuid = ?"
+		args = append(args, filter.TransactionUUID)
+	}
+	if !filter.From.IsZero() {
+		query += " AND received_at >= ?"
+		args = append(args, s.dialect.time(filter.From))
+	}
+	if !filter.To.IsZero() {
+		query += " AND received_at < ?"
+		args = append(args, s.dialect.time(filter.To))
+	}
+	if filter.Status != "" {
+		query += " AND status = ?"
+		args = append(args, filter.Status)
+	}
+	query += " ORDER BY id"
+
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	events := []WebhookEvent{}
+	for rows.Next() {
+		ev, err := scanWebhookEvent(rows)
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, *ev)
+	}
+	return events, rows.Err()
+}
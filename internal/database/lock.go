@@ -0,0 +1,97 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+var ErrLockTimeout = errors.New("timed out waiting for database lock")
+
+// MaxLockName is the longest lock name GET_LOCK accepts.
+const MaxLockName = 64
+
+// checkLockName rejects the names GET_LOCK does not accept, with every store,
+// so that the tests without MariaDB catch them.
+func checkLockName(name string) error {
+	if len(name) > MaxLockName {
+		return fmt.Errorf("lock name %q is longer than %d characters", name, MaxLockName)
+	}
+	return nil
+}
+
+// Lock acquires the named advisory lock with GET_LOCK. The lock belongs to the
+// connection: it is shared by every replica using the same database, and is
+// held until Unlock or until the connection is closed.
+func Lock(ctx context.Context, conn *sql.Conn, name string, timeout time.Duration) error {
+	var got sql.NullInt64
+	err := conn.QueryRowContext(ctx, "SELECT GET_LOCK(?, ?)", name, int(timeout.Seconds())).Scan(&got)
+	if err != nil {
+		return err
+	}
+	if !got.Valid || got.Int64 != 1 {
+		return ErrLockTimeout
+	}
+	return nil
+}
+
+func Unlock(ctx context.Context, conn *sql.Conn, name string) error {
+	_, err := conn.ExecContext(ctx, "SELECT RELEASE_LOCK(?)", name)
+	return err
+}
+
+// localLocks are named locks that only apply within the process, for
+// databases without advisory locks.
+type localLocks struct {
+	mu    sync.Mutex
+	locks map[string]*localLock
+}
+
+type localLock struct {
+	held    chan struct{}
+	waiters int
+}
+
+// lock acquires the named lock and returns the function releasing it.
+func (l *localLocks) lock(ctx context.Context, name string, timeout time.Duration) (func(), error) {
+	l.mu.Lock()
+	if l.locks == nil {
+		l.locks = map[string]*localLock{}
+	}
+	ll, ok := l.locks[name]
+	if !ok {
+		ll = &localLock{held: make(chan struct{}, 1)}
+		l.locks[name] = ll
+	}
+	ll.waiters += 1
+	l.mu.Unlock()
+
+	// forget the lock once nobody needs it anymore
+	done := func() {
+		l.mu.Lock()
+		ll.waiters -= 1
+		if ll.waiters == 0 {
+			delete(l.locks, name)
+		}
+		l.mu.Unlock()
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	select {
+	case ll.held <- struct{}{}:
+		return func() {
+			<-ll.held
+			done()
+		}, nil
+	case <-ctx.Done():
+		done()
+		if errors.Is(ctx.Err(), context.Canceled) {
+			return nil, ctx.Err()
+		}
+		return nil, ErrLockTimeout
+	}
+}
@@ -0,0 +1,133 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+var mariaDB = &dialect{
+	migrations:     "migrations/mariadb",
+	now:            "NOW()",
+	secondsFromNow: "DATE_ADD(NOW(), INTERVAL ? SECOND)",
+	upsertSQL: func(_ string, columns ...string) string {
+		set := []string{}
+		for _, c := range columns {
+			set = append(set, c+" = VALUES("+c+")")
+		}
+		return "ON DUPLICATE KEY UPDATE " + strings.Join(set, ", ")
+	},
+	insertIgnore: "INSERT IGNORE",
+	allocate:     mariaDBAllocate,
+	time:         func(t time.Time) any { return t },
+	lock: func(ctx context.Context, conn *sql.Conn, name string, timeout time.Duration) (func(), error) {
+		if err := Lock(ctx, conn, name, timeout); err != nil {
+			return nil, err
+		}
+		return func() {
+			if err := Unlock(context.WithoutCancel(ctx), conn, name); err != nil {
+				slog.Error("unable to release database lock", "lock", name, "error", err)
+			}
+		}, nil
+	},
+	missingTable: func(err error) bool {
+		var myErr *mysql.MySQLError
+		return errors.As(err, &myErr) && myErr.Number == 1146
+	},
+}
+
+// OpenMariaDB connects to MariaDB. The connection pool is configured from
+// MARIADB_MAX_OPEN_CONNS, MARIADB_MAX_IDLE_CONNS, MARIADB_CONN_MAX_LIFETIME
+// and MARIADB_CONN_MAX_IDLE_TIME.
+func OpenMariaDB() (Store, error) {
+	host := os.Getenv("MARIADB_HOST")
+	user := os.Getenv("MARIADB_USER")
+	password := os.Getenv("MARIADB_PASSWORD")
+	database := os.Getenv("MARIADB_DATABASE")
+
+	dsn := fmt.Sprintf("%s:%s@tcp(%s)/%s?parseTime=true", user, password, host, database)
+	db, err := sql.Open("mysql", dsn)
+	if err != nil {
+		return nil, fmt.Errorf("error connecting to database: %v", err)
+	}
+	if err := configurePool(db); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("error connecting to database %s: %v", host, err)
+	}
+	return NewMariaDB(db), nil
+}
+
+// NewMariaDB returns the store of an open MariaDB database.
+func NewMariaDB(db *sql.DB) Store {
+	return &sqlStore{sqlQueries: sqlQueries{db: db, dialect: mariaDB}, db: db}
+}
+
+// configurePool applies the connection pool settings given in the
+// environment. Unset variables keep the database/sql defaults.
+func configurePool(db *sql.DB) error {
+	for _, v := range []struct {
+		env string
+		set func(int)
+	}{
+		{"MARIADB_MAX_OPEN_CONNS", db.SetMaxOpenConns},
+		{"MARIADB_MAX_IDLE_CONNS", db.SetMaxIdleConns},
+	} {
+		if s := os.Getenv(v.env); s != "" {
+			n, err := strconv.Atoi(s)
+			if err != nil {
+				return fmt.Errorf("invalid %s %q: %v", v.env, s, err)
+			}
+			v.set(n)
+		}
+	}
+
+	for _, v := range []struct {
+		env string
+		set func(time.Duration)
+	}{
+		{"MARIADB_CONN_MAX_LIFETIME", db.SetConnMaxLifetime},
+		{"MARIADB_CONN_MAX_IDLE_TIME", db.SetConnMaxIdleTime},
+	} {
+		if s := os.Getenv(v.env); s != "" {
+			d, err := time.ParseDuration(s)
+			if err != nil {
+				return fmt.Errorf("invalid %s %q: %v", v.env, s, err)
+			}
+			v.set(d)
+		}
+	}
+	return nil
+}
+
+// mariaDBAllocate relies on LAST_INSERT_ID to return the new value of the
+// counter. Within a transaction, the counter row stays locked until commit.
+func mariaDBAllocate(db DBTX, counter string, n int) (int, error) {
+	_, err := db.Exec("INSERT IGNORE INTO counters (name, value) VALUES (?, 0)", counter)
+	if err != nil {
+		return -1, err
+	}
+
+	res, err := db.Exec("UPDATE counters SET value = LAST_INSERT_ID(value + ?) WHERE name = ?", n, counter)
+	if err != nil {
+		return -1, err
+	}
+	last, err := res.LastInsertId()
+	if err != nil {
+		return -1, err
+	}
+
+	return int(last) - n + 1, nil
+}
@@ -0,0 +1,738 @@
+package database
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Memory is a Store keeping everything in memory, for tests and trials: its
+// data is lost on exit. Transactions run one at a time whatever their lock,
+// and their changes are visible to others before they commit.
+type Memory struct {
+	memoryQueries
+	locks localLocks
+}
+
+func NewMemory() *Memory {
+	return &Memory{
+		memoryQueries: memoryQueries{s: &memoryState{
+			counters:  map[string]int{},
+			customers: map[string]Customer{},
+			passes:    map[string]Pass{},
+		}},
+	}
+}
+
+type memoryState struct {
+	mu        sync.Mutex
+	counters  map[string]int
+	processed []*memoryRecord
+	customers map[string]Customer
+	passes    map[string]Pass
+	outbox    []*memoryOutboxEntry
+	events    []*memoryEvent
+	privacy   []PrivacyRequest
+	lastID    int64
+}
+
+type memoryRecord struct {
+	ProcessedRecord
+	warnings    []byte
+	processedAt time.Time
+}
+
+type memoryOutboxEntry struct {
+	OutboxEntry
+	status    string
+	lastError string
+	createdAt time.Time
+}
+
+type memoryEvent struct {
+	WebhookEvent
+	payloadHash   string
+	nextAttemptAt time.Time
+}
+
+// memoryQueries implements Queries on the state of a Memory store.
+type memoryQueries struct {
+	s *memoryState
+	// undo reverts the changes made within a transaction, it is nil outside
+	// of transactions.
+	undo *[]func()
+}
+
+// onRollback registers how to revert a change, when within a transaction.
+func (q memoryQueries) onRollback(f func()) {
+	if q.undo != nil {
+		*q.undo = append(*q.undo, f)
+	}
+}
+
+func (s *memoryState) nextID() int64 {
+	s.lastID += 1
+	return s.lastID
+}
+
+func (q memoryQueries) PeekCounter(counter string) (int, error) {
+	q.s.mu.Lock()
+	defer q.s.mu.Unlock()
+
+	return q.s.counters[counter], nil
+}
+
+func (q memoryQueries) AllocateCounter(counter string, n int) (int, error) {
+	q.s.mu.Lock()
+	defer q.s.mu.Unlock()
+
+	old, existed := q.s.counters[counter]
+	q.s.counters[counter] = old + n
+	q.onRollback(func() {
+		if existed {
+			q.s.counters[counter] = old
+		} else {
+			delete(q.s.counters, counter)
+		}
+	})
+	return old + 1, nil
+}
+
+func (q memoryQueries) record(clientHash, transactionID string) *memoryRecord {
+	for _, r := range q.s.processed {
+		if r.ClientHash == clientHash && r.TransactionID == transactionID {
+			return r
+		}
+	}
+	return nil
+}
+
+func (q memoryQueries) IsTransactionProcessed(clientHash, transactionID string) (bool, error) {
+	q.s.mu.Lock()
+	defer q.s.mu.Unlock()
+
+	return q.record(clientHash, transactionID) != nil, nil
+}
+
+func (q memoryQueries) RecordProcessedTransaction(clientHash, transactionID, tiersCode string, warnings []byte) error {
+	q.s.mu.Lock()
+	defer q.s.mu.Unlock()
+
+	if r := q.record(clientHash, transactionID); r != nil {
+		old := *r
+		r.TiersCode, r.warnings, r.Reversed, r.processedAt = tiersCode, warnings, false, time.Now()
+		q.onRollback(func() { *r = old })
+		return nil
+	}
+
+	r := &memoryRecord{
+		ProcessedRecord: ProcessedRecord{ClientHash: clientHash, TransactionID: transactionID, TiersCode: tiersCode},
+		warnings:        warnings,
+		processedAt:     time.Now(),
+	}
+	q.s.processed = append(q.s.processed, r)
+	q.onRollback(func() {
+		q.s.processed = slices.DeleteFunc(q.s.processed, func(o *memoryRecord) bool { return o == r })
+	})
+	return nil
+}
+
+func (q memoryQueries) GetProcessedTransaction(clientHash, transactionID string) (*ProcessedRecord, error) {
+	q.s.mu.Lock()
+	defer q.s.mu.Unlock()
+
+	r := q.record(clientHash, transactionID)
+	if r == nil {
+		return nil, nil
+	}
+	rec := r.ProcessedRecord
+	return &rec, nil
+}
+
+func (q memoryQueries) MarkTransactionReversed(clientHash, transactionID string) (bool, error) {
+	q.s.mu.Lock()
+	defer q.s.mu.Unlock()
+
+	r := q.record(clientHash, transactionID)
+	if r == nil || r.Reversed {
+		return false, nil
+	}
+	r.Reversed = true
+	q.onRollback(func() { r.Reversed = false })
+	return true, nil
+}
+
+func (q memoryQueries) CustomerTiersCode(clientHash, code string) (string, error) {
+	q.s.mu.Lock()
+	defer q.s.mu.Unlock()
+
+	// records are in insertion order, the latest processed wins
+	var latest *memoryRecord
+	for _, r := range q.s.processed {
+		if r.ClientHash != clientHash || r.TiersCode == "" || (code != "" && r.TiersCode != code) {
+			continue
+		}
+		if latest == nil || !r.processedAt.Before(latest.processedAt) {
+			latest = r
+		}
+	}
+	if latest == nil {
+		return "", nil
+	}
+	return latest.TiersCode, nil
+}
+
+func (q memoryQueries) ClientHashExists(clientHash string) (bool, error) {
+	q.s.mu.Lock()
+	defer q.s.mu.Unlock()
+
+	for _, r := range q.s.processed {
+		if r.ClientHash == clientHash {
+			return true, nil
+		}
+	}
+	for _, c := range q.s.customers {
+		if c.ClientHash == clientHash {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (q memoryQueries) ClientHashes() ([]string, error) {
+	q.s.mu.Lock()
+	defer q.s.mu.Unlock()
+
+	hashes := []string{}
+	for _, r := range q.s.processed {
+		hashes = append(hashes, r.ClientHash)
+	}
+	for _, c := range q.s.customers {
+		hashes = append(hashes, c.ClientHash)
+	}
+	slices.Sort(hashes)
+	return slices.Compact(hashes), nil
+}
+
+func (q memoryQueries) RehashClient(from, to string) error {
+	q.s.mu.Lock()
+	defer q.s.mu.Unlock()
+
+	old := slices.Clone(q.s.processed)
+	kept := []*memoryRecord{}
+	for _, r := range q.s.processed {
+		if r.ClientHash == from && q.record(to, r.TransactionID) != nil {
+			continue
+		}
+		kept = append(kept, r)
+	}
+	for _, r := range kept {
+		if r.ClientHash == from {
+			r.ClientHash = to
+			q.onRollback(func() { r.ClientHash = from })
+		}
+	}
+	q.s.processed = kept
+	q.onRollback(func() { q.s.processed = old })
+
+	for code, c := range q.s.customers {
+		if c.ClientHash == from {
+			c.ClientHash = to
+			q.s.customers[code] = c
+			q.onRollback(func() {
+				c.ClientHash = from
+				q.s.customers[code] = c
+			})
+		}
+	}
+	return nil
+}
+
+func (q memoryQueries) SaveCustomer(c Customer) error {
+	q.s.mu.Lock()
+	defer q.s.mu.Unlock()
+
+	now := time.Now()
+	old, existed := q.s.customers[c.TiersCode]
+	c.CreatedAt, c.UpdatedAt = now, now
+	if existed {
+		c.CreatedAt = old.CreatedAt
+	}
+	q.s.customers[c.TiersCode] = c
+	q.onRollback(func() {
+		if existed {
+			q.s.customers[c.TiersCode] = old
+		} else {
+			delete(q.s.customers, c.TiersCode)
+		}
+	})
+	return nil
+}
+
+func (q memoryQueries) FindCustomers(clientHash, tiersCode string) ([]Customer, error) {
+	q.s.mu.Lock()
+	defer q.s.mu.Unlock()
+
+	customers := []Customer{}
+	for _, c := range q.s.customers {
+		if (clientHash != "" && c.ClientHash == clientHash) || (clientHash == "" && c.TiersCode == tiersCode) {
+			customers = append(customers, c)
+		}
+	}
+	slices.SortFunc(customers, func(a, b Customer) int { return strings.Compare(a.TiersCode, b.TiersCode) })
+	return customers, nil
+}
+
+func (q memoryQueries) AddPass(p Pass) error {
+	q.s.mu.Lock()
+	defer q.s.mu.Unlock()
+
+	if _, ok := q.s.passes[p.ParkCode]; ok {
+		return fmt.Errorf("duplicate pass %s", p.ParkCode)
+	}
+	p.Active = true
+	q.s.passes[p.ParkCode] = p
+	q.onRollback(func() { delete(q.s.passes, p.ParkCode) })
+	return nil
+}
+
+func (q memoryQueries) queryPasses(keep func(Pass) bool) []Pass {
+	q.s.mu.Lock()
+	defer q.s.mu.Unlock()
+
+	passes := []Pass{}
+	for _, p := range q.s.passes {
+		if keep(p) {
+			passes = append(passes, p)
+		}
+	}
+	slices.SortFunc(passes, func(a, b Pass) int { return strings.Compare(a.ParkCode, b.ParkCode) })
+	return passes
+}
+
+func (q memoryQueries) ActiveTransactionPasses(transactionID string) ([]Pass, error) {
+	return q.queryPasses(func(p Pass) bool { return p.TransactionID == transactionID && p.Active }), nil
+}
+
+func (q memoryQueries) TiersPasses(tiersCode string) ([]Pass, error) {
+	return q.queryPasses(func(p Pass) bool { return p.TiersCode == tiersCode }), nil
+}
+
+func (q memoryQueries) CountActivePasses(tiersCode string) (int, error) {
+	return len(q.queryPasses(func(p Pass) bool { return p.TiersCode == tiersCode && p.Active })), nil
+}
+
+func (q memoryQueries) DeactivateTransactionPasses(transactionID string) error {
+	q.s.mu.Lock()
+	defer q.s.mu.Unlock()
+
+	for code, p := range q.s.passes {
+		if p.TransactionID == transactionID && p.Active {
+			p.Active = false
+			q.s.passes[code] = p
+			q.onRollback(func() {
+				p.Active = true
+				q.s.passes[code] = p
+			})
+		}
+	}
+	return nil
+}
+
+func (q memoryQueries) AddOutboxEntry(transactionID, path string, content []byte) error {
+	q.s.mu.Lock()
+	defer q.s.mu.Unlock()
+
+	for _, e := range q.s.outbox {
+		if e.Path == path {
+			return fmt.Errorf("duplicate outbox entry %s", path)
+		}
+	}
+	e := &memoryOutboxEntry{
+		OutboxEntry: OutboxEntry{ID: q.s.nextID(), TransactionID: transactionID, Path: path, Content: content},
+		status:      OutboxPending,
+		createdAt:   time.Now(),
+	}
+	q.s.outbox = append(q.s.outbox, e)
+	q.onRollback(func() {
+		q.s.outbox = slices.DeleteFunc(q.s.outbox, func(o *memoryOutboxEntry) bool { return o == e })
+	})
+	return nil
+}
+
+func (q memoryQueries) PendingOutboxEntries(transactionID string, olderThan time.Duration) ([]OutboxEntry, error) {
+	q.s.mu.Lock()
+	defer q.s.mu.Unlock()
+
+	entries := []OutboxEntry{}
+	for _, e := range q.s.outbox {
+		if e.status != OutboxPending {
+			continue
+		}
+		if (transactionID != "" && e.TransactionID == transactionID) ||
+			(transactionID == "" && time.Since(e.createdAt) >= olderThan) {
+			entries = append(entries, e.OutboxEntry)
+		}
+	}
+	return entries, nil
+}
+
+func (q memoryQueries) updateOutboxEntry(id int64, update func(e *memoryOutboxEntry)) error {
+	q.s.mu.Lock()
+	defer q.s.mu.Unlock()
+
+	for _, e := range q.s.outbox {
+		if e.ID == id {
+			old := *e
+			update(e)
+			q.onRollback(func() { *e = old })
+		}
+	}
+	return nil
+}
+
+func (q memoryQueries) MarkOutboxUploaded(id int64) error {
+	return q.updateOutboxEntry(id, func(e *memoryOutboxEntry) {
+		e.status, e.lastError = OutboxUploaded, ""
+	})
+}
+
+func (q memoryQueries) MarkOutboxFailedAttempt(id int64, cause error) error {
+	return q.updateOutboxEntry(id, func(e *memoryOutboxEntry) {
+		e.Attempts += 1
+		e.lastError = cause.Error()
+	})
+}
+
+func (q memoryQueries) LatestOutboxContent(base string) ([]byte, error) {
+	q.s.mu.Lock()
+	defer q.s.mu.Unlock()
+
+	for _, e := range slices.Backward(q.s.outbox) {
+		if e.Path == base+".json" || (strings.HasPrefix(e.Path, base+"_") && strings.HasSuffix(e.Path, ".json")) {
+			return e.Content, nil
+		}
+	}
+	return nil, nil
+}
+
+func (q memoryQueries) ClientTransactions(clientHash string) ([]ProcessedRecord, error) {
+	q.s.mu.Lock()
+	defer q.s.mu.Unlock()
+
+	records := []ProcessedRecord{}
+	for _, r := range q.s.processed {
+		if r.ClientHash == clientHash {
+			records = append(records, r.ProcessedRecord)
+		}
+	}
+	return records, nil
+}
+
+func (q memoryQueries) TransactionOutboxEntries(transactionID string) ([]OutboxEntry, error) {
+	q.s.mu.Lock()
+	defer q.s.mu.Unlock()
+
+	entries := []OutboxEntry{}
+	for _, e := range q.s.outbox {
+		if e.TransactionID == transactionID {
+			entries = append(entries, e.OutboxEntry)
+		}
+	}
+	return entries, nil
+}
+
+func (q memoryQueries) DeleteTransactionOutboxEntries(transactionID string) error {
+	q.s.mu.Lock()
+	defer q.s.mu.Unlock()
+
+	old := slices.Clone(q.s.outbox)
+	q.s.outbox = slices.DeleteFunc(q.s.outbox, func(e *memoryOutboxEntry) bool { return e.TransactionID == transactionID })
+	q.onRollback(func() { q.s.outbox = old })
+	return nil
+}
+
+func (q memoryQueries) AnonymizeTiers(tiersCode string) error {
+	q.s.mu.Lock()
+	defer q.s.mu.Unlock()
+
+	if c, ok := q.s.customers[tiersCode]; ok {
+		delete(q.s.customers, tiersCode)
+		q.onRollback(func() { q.s.customers[tiersCode] = c })
+	}
+	for code, p := range q.s.passes {
+		if p.TiersCode == tiersCode {
+			old := p
+			p.Plate = ""
+			q.s.passes[code] = p
+			q.onRollback(func() { q.s.passes[code] = old })
+		}
+	}
+	for _, r := range q.s.processed {
+		if r.TiersCode == tiersCode {
+			old := r.warnings
+			r.warnings = nil
+			q.onRollback(func() { r.warnings = old })
+		}
+	}
+	return nil
+}
+
+func (q memoryQueries) RecordPrivacyRequest(r PrivacyRequest) error {
+	q.s.mu.Lock()
+	defer q.s.mu.Unlock()
+
+	r.ID, r.CreatedAt = q.s.nextID(), time.Now()
+	q.s.privacy = append(q.s.privacy, r)
+	q.onRollback(func() {
+		q.s.privacy = slices.DeleteFunc(q.s.privacy, func(o PrivacyRequest) bool { return o.ID == r.ID })
+	})
+	return nil
+}
+
+func (q memoryQueries) ListPrivacyRequests(clientHash string) ([]PrivacyRequest, error) {
+	q.s.mu.Lock()
+	defer q.s.mu.Unlock()
+
+	requests := []PrivacyRequest{}
+	for _, r := range q.s.privacy {
+		if r.ClientHash == clientHash {
+			requests = append(requests, r)
+		}
+	}
+	return requests, nil
+}
+
+func (m *Memory) QueueWebhookEvent(transactionUUID string, payload []byte, lease time.Duration) (*WebhookEvent, bool, error) {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+
+	payloadHash := fmt.Sprintf("%x", sha256.Sum256(payload))
+	var existing *memoryEvent
+	for _, ev := range m.s.events {
+		if ev.payloadHash == payloadHash {
+			existing = ev
+		}
+	}
+
+	now := time.Now()
+	if existing == nil {
+		ev := &memoryEvent{
+			WebhookEvent: WebhookEvent{
+				ID:              m.s.nextID(),
+				TransactionUUID: transactionUUID,
+				Status:          EventProcessing,
+				Attempts:        1,
+				Payload:         payload,
+				ReceivedAt:      now,
+			},
+			payloadHash:   payloadHash,
+			nextAttemptAt: now.Add(lease),
+		}
+		m.s.events = append(m.s.events, ev)
+		return &ev.WebhookEvent, true, nil
+	}
+
+	// a redelivery does not wait for the backoff of a pending event
+	switch existing.Status {
+	case EventPending, EventFailed:
+	case EventProcessing:
+		if now.Before(existing.nextAttemptAt) {
+			ev := existing.WebhookEvent
+			return &ev, false, nil
+		}
+	default:
+		ev := existing.WebhookEvent
+		return &ev, false, nil
+	}
+	existing.claim(lease)
+	ev := existing.WebhookEvent
+	return &ev, true, nil
+}
+
+func (ev *memoryEvent) claim(lease time.Duration) {
+	ev.Status = EventProcessing
+	ev.Attempts += 1
+	ev.nextAttemptAt = time.Now().Add(lease)
+}
+
+func (m *Memory) ClaimWebhookEvent(lease time.Duration) (*WebhookEvent, error) {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+
+	now := time.Now()
+	for _, ev := range m.s.events {
+		if (ev.Status == EventPending || ev.Status == EventProcessing) && !now.Before(ev.nextAttemptAt) {
+			ev.claim(lease)
+			claimed := ev.WebhookEvent
+			return &claimed, nil
+		}
+	}
+	return nil, nil
+}
+
+func (m *Memory) ReclaimWebhookEvent(ev *WebhookEvent, lease time.Duration) (bool, error) {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+
+	for _, e := range m.s.events {
+		if e.ID != ev.ID {
+			continue
+		}
+		if e.Status != ev.Status || e.Attempts != ev.Attempts ||
+			(e.Status == EventProcessing && time.Now().Before(e.nextAttemptAt)) {
+			return false, nil
+		}
+		e.claim(lease)
+		ev.Status, ev.Attempts = e.Status, e.Attempts
+		return true, nil
+	}
+	return false, nil
+}
+
+func (m *Memory) updateEvent(id int64, update func(ev *memoryEvent)) error {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+
+	for _, ev := range m.s.events {
+		if ev.ID == id {
+			update(ev)
+		}
+	}
+	return nil
+}
+
+func (m *Memory) CompleteWebhookEvent(id int64) error {
+	return m.updateEvent(id, func(ev *memoryEvent) {
+		ev.Status, ev.LastError = EventDone, ""
+	})
+}
+
+func (m *Memory) RetryWebhookEvent(id int64, cause error, delay time.Duration) error {
+	return m.updateEvent(id, func(ev *memoryEvent) {
+		ev.Status, ev.LastError, ev.nextAttemptAt = EventPending, cause.Error(), time.Now().Add(delay)
+	})
+}
+
+func (m *Memory) FailWebhookEvent(id int64, cause error) error {
+	return m.updateEvent(id, func(ev *memoryEvent) {
+		ev.Status, ev.LastError = EventFailed, cause.Error()
+	})
+}
+
+func (m *Memory) RejectWebhookEvent(id int64, cause error) error {
+	return m.updateEvent(id, func(ev *memoryEvent) {
+		ev.Status, ev.LastError = EventRejected, cause.Error()
+	})
+}
+
+func (m *Memory) ReviewWebhookEvent(id int64, cause error) error {
+	return m.updateEvent(id, func(ev *memoryEvent) {
+		ev.Status, ev.LastError = EventPendingReview, cause.Error()
+	})
+}
+
+func (m *Memory) SetWebhookEventOverrides(id int64, overrides []byte) error {
+	return m.updateEvent(id, func(ev *memoryEvent) {
+		ev.Overrides = overrides
+	})
+}
+
+func (m *Memory) GetWebhookEvent(id int64) (*WebhookEvent, error) {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+
+	for _, ev := range m.s.events {
+		if ev.ID == id {
+			found := ev.WebhookEvent
+			return &found, nil
+		}
+	}
+	return nil, nil
+}
+
+func (m *Memory) ListWebhookEvents(filter EventFilter) ([]WebhookEvent, error) {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+
+	events := []WebhookEvent{}
+	for _, ev := range m.s.events {
+		if (filter.TransactionUUID != "" && ev.TransactionUUID != filter.TransactionUUID) ||
+			(!filter.From.IsZero() && ev.ReceivedAt.Before(filter.From)) ||
+			(!filter.To.IsZero() && !ev.ReceivedAt.Before(filter.To)) ||
+			(filter.Status != "" && ev.Status != filter.Status) {
+			continue
+		}
+		events = append(events, ev.WebhookEvent)
+	}
+	return events, nil
+}
+
+func (m *Memory) DeleteWebhookEvent(id int64) error {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+
+	m.s.events = slices.DeleteFunc(m.s.events, func(ev *memoryEvent) bool { return ev.ID == id })
+	return nil
+}
+
+func (m *Memory) Begin(ctx context.Context, lock string, timeout time.Duration) (Tx, error) {
+	if err := checkLockName(lock); err != nil {
+		return nil, err
+	}
+	release, err := m.locks.lock(ctx, "transaction", timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	tx := &memoryTx{release: release}
+	tx.memoryQueries = memoryQueries{s: m.s, undo: &tx.changes}
+	return tx, nil
+}
+
+func (m *Memory) Migrate(ctx context.Context) error {
+	return nil
+}
+
+func (m *Memory) MigrationStatuses(ctx context.Context) ([]MigrationStatus, error) {
+	return []MigrationStatus{}, nil
+}
+
+func (m *Memory) Ping(ctx context.Context) error {
+	return nil
+}
+
+func (m *Memory) Close() error {
+	return nil
+}
+
+type memoryTx struct {
+	memoryQueries
+	changes []func()
+	release func()
+}
+
+func (t *memoryTx) Commit() error {
+	t.changes = nil
+	t.undo = nil
+	return nil
+}
+
+func (t *memoryTx) Rollback() error {
+	t.s.mu.Lock()
+	for _, undo := range slices.Backward(t.changes) {
+		undo()
+	}
+	t.changes = nil
+	t.s.mu.Unlock()
+
+	if t.release != nil {
+		t.release()
+		t.release = nil
+	}
+	return nil
+}
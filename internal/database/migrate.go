@@ -0,0 +1,206 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Migrations are named <version>_<name>.sql and applied in version order,
+// with one directory per dialect. Statements end with a semicolon at the end
+// of a line. As MariaDB commits DDL statements implicitly, migrations must be
+// safe to run again should one fail halfway, e.g. with IF NOT EXISTS.
+//
+//go:embed migrations
+var migrationFiles embed.FS
+
+const (
+	migrationLock        = "importer:migrations"
+	migrationLockTimeout = 5 * time.Minute
+)
+
+// Migration is a schema change.
+type Migration struct {
+	Version    int
+	Name       string
+	Statements []string
+}
+
+// MigrationStatus is a migration along with the time it was applied at, which
+// is zero for pending migrations.
+type MigrationStatus struct {
+	Migration
+	AppliedAt time.Time
+}
+
+// loadMigrations returns the embedded migrations of dir, in order.
+func loadMigrations(dir string) ([]Migration, error) {
+	entries, err := fs.ReadDir(migrationFiles, dir)
+	if err != nil {
+		return nil, err
+	}
+
+	migrations := []Migration{}
+	for _, e := range entries {
+		prefix, name, ok := strings.Cut(strings.TrimSuffix(e.Name(), ".sql"), "_")
+		version, err := strconv.Atoi(prefix)
+		if !ok || err != nil || version < 1 {
+			return nil, fmt.Errorf("invalid migration file name %s", e.Name())
+		}
+		if n := len(migrations); n > 0 && migrations[n-1].Version == version {
+			return nil, fmt.Errorf("duplicate migration version %d", version)
+		}
+
+		content, err := migrationFiles.ReadFile(dir + "/" + e.Name())
+		if err != nil {
+			return nil, err
+		}
+		statements := splitStatements(string(content))
+		if len(statements) == 0 {
+			return nil, fmt.Errorf("empty migration %s", e.Name())
+		}
+		migrations = append(migrations, Migration{Version: version, Name: name, Statements: statements})
+	}
+	return migrations, nil
+}
+
+func splitStatements(content string) []string {
+	statements := []string{}
+	current := strings.Builder{}
+	for _, line := range strings.Split(content, "\n") {
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || strings.HasPrefix(trimmed, "--") {
+			continue
+		}
+		current.WriteString(line + "\n")
+		if strings.HasSuffix(trimmed, ";") {
+			statements = append(statements, strings.TrimSuffix(strings.TrimSpace(current.String()), ";"))
+			current.Reset()
+		}
+	}
+	if rest := strings.TrimSpace(current.String()); rest != "" {
+		statements = append(statements, rest)
+	}
+	return statements
+}
+
+// CheckSchema fails if migrations are pending, for the commands that must not
+// apply them.
+func CheckSchema(ctx context.Context, s Store) error {
+	statuses, err := s.MigrationStatuses(ctx)
+	if err != nil {
+		return fmt.Errorf("unable to read the applied migrations: %w", err)
+	}
+	pending := 0
+	for _, st := range statuses {
+		if st.AppliedAt.IsZero() {
+			pending += 1
+		}
+	}
+	if pending > 0 {
+		return fmt.Errorf("the database schema is behind, %d migrations pending: run migrate up first", pending)
+	}
+	return nil
+}
+
+// Migrate applies the pending migrations. Replicas starting together wait for
+// each other on a database lock.
+func (s *sqlStore) Migrate(ctx context.Context) error {
+	migrations, err := loadMigrations(s.dialect.migrations)
+	if err != nil {
+		return fmt.Errorf("invalid migrations: %v", err)
+	}
+
+	conn, err := s.db.Conn(ctx)
+	if err != nil {
+		return fmt.Errorf("unable to get a database connection: %v", err)
+	}
+	defer conn.Close()
+
+	unlock, err := s.dialect.lock(ctx, conn, migrationLock, migrationLockTimeout)
+	if err != nil {
+		return fmt.Errorf("unable to lock migrations: %v", err)
+	}
+	defer unlock()
+
+	_, err = conn.ExecContext(ctx, `
+        CREATE TABLE IF NOT EXISTS schema_migrations (
+            version INT NOT NULL PRIMARY KEY,
+            name VARCHAR(255) NOT NULL,
+            applied_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+        )
+    `)
+	if err != nil {
+		return fmt.Errorf("error creating table: %v", err)
+	}
+
+	applied, err := s.appliedMigrations(ctx, conn)
+	if err != nil {
+		return err
+	}
+
+	for _, m := range migrations {
+		if _, ok := applied[m.Version]; ok {
+			continue
+		}
+
+		slog.Info("applying migration", "version", m.Version, "name", m.Name)
+		for _, stmt := range m.Statements {
+			if _, err := conn.ExecContext(ctx, stmt); err != nil {
+				return fmt.Errorf("migration %d (%s) failed: %v", m.Version, m.Name, err)
+			}
+		}
+		_, err := conn.ExecContext(ctx, "INSERT INTO schema_migrations (version, name) VALUES (?, ?)", m.Version, m.Name)
+		if err != nil {
+			return fmt.Errorf("unable to record migration %d: %v", m.Version, err)
+		}
+	}
+	return nil
+}
+
+func (s *sqlStore) MigrationStatuses(ctx context.Context) ([]MigrationStatus, error) {
+	migrations, err := loadMigrations(s.dialect.migrations)
+	if err != nil {
+		return nil, fmt.Errorf("invalid migrations: %v", err)
+	}
+	applied, err := s.appliedMigrations(ctx, s.db)
+	if err != nil {
+		return nil, err
+	}
+
+	statuses := []MigrationStatus{}
+	for _, m := range migrations {
+		statuses = append(statuses, MigrationStatus{Migration: m, AppliedAt: applied[m.Version]})
+	}
+	return statuses, nil
+}
+
+func (s *sqlStore) appliedMigrations(ctx context.Context, db interface {
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+}) (map[int]time.Time, error) {
+	applied := map[int]time.Time{}
+	rows, err := db.QueryContext(ctx, "SELECT version, applied_at FROM schema_migrations")
+	if s.dialect.missingTable(err) {
+		// no migration was ever applied
+		return applied, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("unable to list applied migrations: %v", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var version int
+		var appliedAt time.Time
+		if err := rows.Scan(&version, &appliedAt); err != nil {
+			return nil, err
+		}
+		applied[version] = appliedAt
+	}
+	return applied, rows.Err()
+}
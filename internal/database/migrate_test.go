@@ -0,0 +1,73 @@
+package database
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMigrations(t *testing.T) {
+	for _, d := range []*dialect{mariaDB, sqliteDialect()} {
+		migrations, err := loadMigrations(d.migrations)
+		require.NoError(t, err)
+		require.NotEmpty(t, migrations)
+
+		for i, m := range migrations {
+			assert.Equal(t, i+1, m.Version, "migration versions must be consecutive")
+			assert.NotEmpty(t, m.Name)
+			for _, stmt := range m.Statements {
+				assert.NotEmpty(t, stmt)
+				assert.NotContains(t, stmt, ";", "%s/%d_%s: statements are split on semicolons", d.migrations, m.Version, m.Name)
+			}
+		}
+	}
+}
+
+func TestSplitStatements(t *testing.T) {
+	assert.Equal(t, []string{
+		"CREATE TABLE a (\n    id INT\n)",
+		"ALTER TABLE a ADD COLUMN b INT",
+		"DROP TABLE c",
+	}, splitStatements(`
+-- first
+CREATE TABLE a (
+    id INT
+);
+
+ALTER TABLE a ADD COLUMN b INT;
+DROP TABLE c
+`))
+}
+
+func TestMigrate(t *testing.T) {
+	ctx := context.Background()
+	for name, open := range map[string]func(t *testing.T) Store{
+		BackendMariaDB: openMariaDBTest,
+		BackendSQLite:  openSQLiteTest,
+	} {
+		t.Run(name, func(t *testing.T) {
+			store := open(t)
+
+			statuses, err := store.MigrationStatuses(ctx)
+			require.NoError(t, err)
+			require.NotEmpty(t, statuses)
+			for _, s := range statuses {
+				assert.True(t, s.AppliedAt.IsZero())
+			}
+			assert.Error(t, CheckSchema(ctx, store))
+
+			// applying again is a no-op
+			require.NoError(t, store.Migrate(ctx))
+			require.NoError(t, store.Migrate(ctx))
+			assert.NoError(t, CheckSchema(ctx, store))
+
+			statuses, err = store.MigrationStatuses(ctx)
+			require.NoError(t, err)
+			for _, s := range statuses {
+				assert.False(t, s.AppliedAt.IsZero(), "migration %d not applied", s.Version)
+			}
+		})
+	}
+}
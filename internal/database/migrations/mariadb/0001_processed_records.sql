@@ -0,0 +1,7 @@
+CREATE TABLE IF NOT EXISTS processed_records (
+    id INT AUTO_INCREMENT PRIMARY KEY,
+    transaction_id VARCHAR(32) NOT NULL,
+    client_hash VARCHAR(32) NOT NULL,
+    processed_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE KEY unique_transaction (client_hash, transaction_id)
+);
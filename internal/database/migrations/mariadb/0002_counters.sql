@@ -0,0 +1,4 @@
+CREATE TABLE IF NOT EXISTS counters (
+    name varchar(32) NOT NULL PRIMARY KEY,
+    value int(11) NOT NULL
+);
@@ -0,0 +1,13 @@
+CREATE TABLE IF NOT EXISTS webhook_events (
+    id BIGINT AUTO_INCREMENT PRIMARY KEY,
+    transaction_uuid VARCHAR(64) NOT NULL DEFAULT '',
+    status VARCHAR(16) NOT NULL,
+    attempts INT NOT NULL DEFAULT 0,
+    last_error TEXT,
+    payload MEDIUMBLOB NOT NULL,
+    received_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    next_attempt_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+    KEY status_next_attempt (status, next_attempt_at),
+    KEY transaction_uuid (transaction_uuid)
+);
@@ -0,0 +1,3 @@
+ALTER TABLE processed_records
+    ADD COLUMN IF NOT EXISTS tiers_code VARCHAR(16) NOT NULL DEFAULT '',
+    ADD COLUMN IF NOT EXISTS reversed_at TIMESTAMP NULL DEFAULT NULL;
@@ -0,0 +1,14 @@
+CREATE TABLE IF NOT EXISTS passes (
+    park_code VARCHAR(16) NOT NULL PRIMARY KEY,
+    plate VARCHAR(32) NOT NULL,
+    tiers_code VARCHAR(16) NOT NULL,
+    transaction_id VARCHAR(64) NOT NULL,
+    company_code VARCHAR(32) NOT NULL,
+    product_code VARCHAR(32) NOT NULL,
+    flow_type VARCHAR(32) NOT NULL,
+    active BOOLEAN NOT NULL DEFAULT TRUE,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    deactivated_at TIMESTAMP NULL DEFAULT NULL,
+    KEY tiers_code (tiers_code),
+    KEY transaction_id (transaction_id)
+);
@@ -0,0 +1,14 @@
+CREATE TABLE IF NOT EXISTS customers (
+    tiers_code VARCHAR(16) NOT NULL PRIMARY KEY,
+    client_hash VARCHAR(32) NOT NULL,
+    label VARCHAR(255) NOT NULL,
+    client_type TINYINT NOT NULL,
+    contact_person VARCHAR(255) NOT NULL DEFAULT '',
+    address VARCHAR(255) NOT NULL DEFAULT '',
+    zip_code VARCHAR(16) NOT NULL DEFAULT '',
+    city VARCHAR(255) NOT NULL DEFAULT '',
+    telephone VARCHAR(32) NOT NULL DEFAULT '',
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+    KEY client_hash (client_hash)
+);
@@ -0,0 +1,2 @@
+ALTER TABLE processed_records
+    ADD COLUMN IF NOT EXISTS warnings TEXT;
@@ -0,0 +1,7 @@
+ALTER TABLE webhook_events
+    ADD COLUMN IF NOT EXISTS overrides TEXT;
+
+-- identical payloads delivered again by Payrexx share their event
+ALTER TABLE webhook_events
+    ADD COLUMN IF NOT EXISTS payload_hash CHAR(64) NOT NULL DEFAULT '',
+    ADD INDEX IF NOT EXISTS payload_hash (payload_hash);
@@ -0,0 +1,3 @@
+-- Payrexx transaction UUIDs do not always fit in 32 characters
+ALTER TABLE processed_records
+    MODIFY transaction_id VARCHAR(64) NOT NULL;
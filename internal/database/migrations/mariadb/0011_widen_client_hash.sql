@@ -0,0 +1,5 @@
+-- keyed client hashes are prefixed with the id of their key
+ALTER TABLE processed_records
+    MODIFY client_hash VARCHAR(64) NOT NULL;
+ALTER TABLE customers
+    MODIFY client_hash VARCHAR(64) NOT NULL;
@@ -0,0 +1,14 @@
+-- payloads stored before payload_hash was introduced
+UPDATE webhook_events SET payload_hash = SHA2(payload, 256) WHERE payload_hash = '';
+
+-- a payload stored twice keeps its hash on its latest event only, the one
+-- its deliveries were matched with so far
+ALTER TABLE webhook_events MODIFY payload_hash CHAR(64) NULL;
+UPDATE webhook_events e
+    JOIN webhook_events newer ON newer.payload_hash = e.payload_hash AND newer.id > e.id
+    SET e.payload_hash = NULL;
+
+-- concurrent deliveries of a payload store a single event
+ALTER TABLE webhook_events
+    DROP INDEX IF EXISTS payload_hash,
+    ADD UNIQUE INDEX payload_hash (payload_hash);
@@ -0,0 +1,76 @@
+-- the schema of the MariaDB migrations 0001 to 0010
+CREATE TABLE IF NOT EXISTS processed_records (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    transaction_id VARCHAR(64) NOT NULL,
+    client_hash VARCHAR(32) NOT NULL,
+    processed_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    tiers_code VARCHAR(16) NOT NULL DEFAULT '',
+    reversed_at TIMESTAMP NULL DEFAULT NULL,
+    warnings TEXT,
+    UNIQUE (client_hash, transaction_id)
+);
+
+CREATE TABLE IF NOT EXISTS counters (
+    name VARCHAR(32) NOT NULL PRIMARY KEY,
+    value INTEGER NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS webhook_events (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    transaction_uuid VARCHAR(64) NOT NULL DEFAULT '',
+    status VARCHAR(16) NOT NULL,
+    attempts INT NOT NULL DEFAULT 0,
+    last_error TEXT,
+    payload BLOB NOT NULL,
+    payload_hash CHAR(64) NOT NULL DEFAULT '',
+    overrides TEXT,
+    received_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    next_attempt_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+CREATE INDEX IF NOT EXISTS webhook_events_status_next_attempt ON webhook_events (status, next_attempt_at);
+CREATE INDEX IF NOT EXISTS webhook_events_transaction_uuid ON webhook_events (transaction_uuid);
+CREATE INDEX IF NOT EXISTS webhook_events_payload_hash ON webhook_events (payload_hash);
+
+CREATE TABLE IF NOT EXISTS outbox (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    transaction_id VARCHAR(64) NOT NULL,
+    object_path VARCHAR(255) NOT NULL UNIQUE,
+    content BLOB NOT NULL,
+    status VARCHAR(16) NOT NULL,
+    attempts INT NOT NULL DEFAULT 0,
+    last_error TEXT,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+CREATE INDEX IF NOT EXISTS outbox_status_created ON outbox (status, created_at);
+
+CREATE TABLE IF NOT EXISTS passes (
+    park_code VARCHAR(16) NOT NULL PRIMARY KEY,
+    plate VARCHAR(32) NOT NULL,
+    tiers_code VARCHAR(16) NOT NULL,
+    transaction_id VARCHAR(64) NOT NULL,
+    company_code VARCHAR(32) NOT NULL,
+    product_code VARCHAR(32) NOT NULL,
+    flow_type VARCHAR(32) NOT NULL,
+    active BOOLEAN NOT NULL DEFAULT TRUE,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    deactivated_at TIMESTAMP NULL DEFAULT NULL
+);
+CREATE INDEX IF NOT EXISTS passes_tiers_code ON passes (tiers_code);
+CREATE INDEX IF NOT EXISTS passes_transaction_id ON passes (transaction_id);
+
+CREATE TABLE IF NOT EXISTS customers (
+    tiers_code VARCHAR(16) NOT NULL PRIMARY KEY,
+    client_hash VARCHAR(32) NOT NULL,
+    label VARCHAR(255) NOT NULL,
+    client_type TINYINT NOT NULL,
+    contact_person VARCHAR(255) NOT NULL DEFAULT '',
+    address VARCHAR(255) NOT NULL DEFAULT '',
+    zip_code VARCHAR(16) NOT NULL DEFAULT '',
+    city VARCHAR(255) NOT NULL DEFAULT '',
+    telephone VARCHAR(32) NOT NULL DEFAULT '',
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+CREATE INDEX IF NOT EXISTS customers_client_hash ON customers (client_hash);
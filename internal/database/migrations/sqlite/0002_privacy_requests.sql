@@ -0,0 +1,11 @@
+-- audit trail of the data access and erasure requests
+CREATE TABLE IF NOT EXISTS privacy_requests (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    kind VARCHAR(16) NOT NULL,
+    client_hash VARCHAR(64) NOT NULL,
+    operator VARCHAR(255) NOT NULL,
+    reason TEXT NOT NULL,
+    details TEXT,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+CREATE INDEX IF NOT EXISTS privacy_requests_client_hash ON privacy_requests (client_hash);
@@ -0,0 +1,11 @@
+-- a payload stored twice keeps its hash on its latest event only, the one
+-- its deliveries were matched with so far
+UPDATE webhook_events SET payload_hash = ''
+WHERE EXISTS (
+    SELECT 1 FROM webhook_events newer
+    WHERE newer.payload_hash = webhook_events.payload_hash AND newer.id > webhook_events.id
+);
+
+-- concurrent deliveries of a payload store a single event
+DROP INDEX IF EXISTS webhook_events_payload_hash;
+CREATE UNIQUE INDEX IF NOT EXISTS webhook_events_payload_hash ON webhook_events (payload_hash) WHERE payload_hash != '';
@@ -0,0 +1,88 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/clementnuss/truckflow-user-importer/internal/metrics"
+)
+
+const (
+	OutboxPending  = "pending"
+	OutboxUploaded = "uploaded"
+)
+
+// OutboxEntry is a Truckflow import file that must be written to the import sink.
+// Entries are recorded in the same database transaction as the counters and
+// the processed record they belong to.
+type OutboxEntry struct {
+	ID            int64
+	TransactionID string
+	Path          string
+	Content       []byte
+	Attempts      int
+}
+
+func (q sqlQueries) AddOutboxEntry(transactionID, path string, content []byte) error {
+	defer metrics.ObserveDBQuery("add_outbox_entry", time.Now())
+
+	_, err := q.db.Exec(
+		"INSERT INTO outbox (transaction_id, object_path, content, status) VALUES (?, ?, ?, ?)",
+		transactionID, path, content, OutboxPending,
+	)
+	return err
+}
+
+func (q sqlQueries) PendingOutboxEntries(transactionID string, olderThan time.Duration) ([]OutboxEntry, error) {
+	defer metrics.ObserveDBQuery("pending_outbox_entries", time.Now())
+
+	query := "SELECT id, transaction_id, object_path, content, attempts FROM outbox WHERE status = ?"
+	args := []any{OutboxPending}
+	if transactionID != "" {
+		query += " AND transaction_id = ?"
+		args = append(args, transactionID)
+	} else {
+		query += " AND created_at <= " + q.dialect.secondsFromNow
+		args = append(args, -int(olderThan.Seconds()))
+	}
+	query += " ORDER BY id"
+
+	rows, err := q.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := []OutboxEntry{}
+	for rows.Next() {
+		e := OutboxEntry{}
+		if err := rows.Scan(&e.ID, &e.TransactionID, &e.Path, &e.Content, &e.Attempts); err != nil {
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
+
+func (q sqlQueries) MarkOutboxUploaded(id int64) error {
+	_, err := q.db.Exec("UPDATE outbox SET status = ?, last_error = NULL WHERE id = ?", OutboxUploaded, id)
+	return err
+}
+
+func (q sqlQueries) MarkOutboxFailedAttempt(id int64, cause error) error {
+	_, err := q.db.Exec("UPDATE outbox SET attempts = attempts + 1, last_error = ? WHERE id = ?", cause.Error(), id)
+	return err
+}
+
+func (q sqlQueries) LatestOutboxContent(base string) ([]byte, error) {
+	var content []byte
+	err := q.db.QueryRow(
+		"SELECT content FROM outbox WHERE object_path = ? OR object_path LIKE ? ESCAPE '!' ORDER BY id DESC LIMIT 1",
+		base+".json", base+"!_%.json",
+	).Scan(&content)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	return content, err
+}
@@ -0,0 +1,73 @@
+package database
+
+import (
+	"time"
+
+	"github.com/clementnuss/truckflow-user-importer/internal/metrics"
+)
+
+// Pass is a Truckflow pass issued for a transaction.
+type Pass struct {
+	ParkCode      string `json:"park_code"`
+	Plate         string `json:"plate"`
+	TiersCode     string `json:"tiers_code"`
+	TransactionID string `json:"transaction_id"`
+	CompanyCode   string `json:"company_code"`
+	ProductCode   string `json:"product_code"`
+	FlowType      string `json:"flow_type"`
+	Active        bool   `json:"active"`
+}
+
+func (q sqlQueries) AddPass(p Pass) error {
+	defer metrics.ObserveDBQuery("add_pass", time.Now())
+
+	_, err := q.db.Exec(`
+        INSERT INTO passes (park_code, plate, tiers_code, transaction_id, company_code, product_code, flow_type)
+        VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		p.ParkCode, p.Plate, p.TiersCode, p.TransactionID, p.CompanyCode, p.ProductCode, p.FlowType,
+	)
+	return err
+}
+
+func (q sqlQueries) ActiveTransactionPasses(transactionID string) ([]Pass, error) {
+	return q.queryPasses("WHERE transaction_id = ? AND active", transactionID)
+}
+
+func (q sqlQueries) TiersPasses(tiersCode string) ([]Pass, error) {
+	return q.queryPasses("WHERE tiers_code = ?", tiersCode)
+}
+
+func (q sqlQueries) DeactivateTransactionPasses(transactionID string) error {
+	_, err := q.db.Exec(
+		"UPDATE passes SET active = FALSE, deactivated_at = CURRENT_TIMESTAMP WHERE transaction_id = ? AND active",
+		transactionID,
+	)
+	return err
+}
+
+func (q sqlQueries) CountActivePasses(tiersCode string) (int, error) {
+	var n int
+	err := q.db.QueryRow("SELECT COUNT(*) FROM passes WHERE tiers_code = ? AND active", tiersCode).Scan(&n)
+	return n, err
+}
+
+func (q sqlQueries) queryPasses(where string, args ...any) ([]Pass, error) {
+	rows, err := q.db.Query(
+		"SELECT park_code, plate, tiers_code, transaction_id, company_code, product_code, flow_type, active FROM passes "+where+" ORDER BY park_code",
+		args...,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	passes := []Pass{}
+	for rows.Next() {
+		p := Pass{}
+		if err := rows.Scan(&p.ParkCode, &p.Plate, &p.TiersCode, &p.TransactionID, &p.CompanyCode, &p.ProductCode, &p.FlowType, &p.Active); err != nil {
+			return nil, err
+		}
+		passes = append(passes, p)
+	}
+	return passes, rows.Err()
+}
@@ -0,0 +1,125 @@
+package database
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/clementnuss/truckflow-user-importer/internal/metrics"
+)
+
+const (
+	PrivacyExport = "export"
+	PrivacyErase  = "erase"
+)
+
+// PrivacyRequest is the audit record of a data access or erasure request. It
+// identifies the customer by their client hash only, so that it survives the
+// erasure.
+type PrivacyRequest struct {
+	ID         int64     `json:"id"`
+	Kind       string    `json:"kind"`
+	ClientHash string    `json:"client_hash"`
+	Operator   string    `json:"operator"`
+	Reason     string    `json:"reason,omitempty"`
+	CreatedAt  time.Time `json:"created_at"`
+	// Details are the JSON encoded summary of what was exported or erased.
+	Details json.RawMessage `json:"details,omitempty"`
+}
+
+func (q sqlQueries) ClientTransactions(clientHash string) ([]ProcessedRecord, error) {
+	defer metrics.ObserveDBQuery("client_transactions", time.Now())
+
+	rows, err := q.db.Query(
+		"SELECT transaction_id, tiers_code, reversed_at IS NOT NULL FROM processed_records WHERE client_hash = ? ORDER BY id",
+		clientHash,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	records := []ProcessedRecord{}
+	for rows.Next() {
+		rec := ProcessedRecord{ClientHash: clientHash}
+		if err := rows.Scan(&rec.TransactionID, &rec.TiersCode, &rec.Reversed); err != nil {
+			return nil, err
+		}
+		records = append(records, rec)
+	}
+	return records, rows.Err()
+}
+
+func (q sqlQueries) TransactionOutboxEntries(transactionID string) ([]OutboxEntry, error) {
+	rows, err := q.db.Query(
+		"SELECT id, transaction_id, object_path, content, attempts FROM outbox WHERE transaction_id = ? ORDER BY id",
+		transactionID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := []OutboxEntry{}
+	for rows.Next() {
+		e := OutboxEntry{}
+		if err := rows.Scan(&e.ID, &e.TransactionID, &e.Path, &e.Content, &e.Attempts); err != nil {
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
+
+func (q sqlQueries) DeleteTransactionOutboxEntries(transactionID string) error {
+	_, err := q.db.Exec("DELETE FROM outbox WHERE transaction_id = ?", transactionID)
+	return err
+}
+
+func (q sqlQueries) AnonymizeTiers(tiersCode string) error {
+	if _, err := q.db.Exec("DELETE FROM customers WHERE tiers_code = ?", tiersCode); err != nil {
+		return err
+	}
+	if _, err := q.db.Exec("UPDATE passes SET plate = '' WHERE tiers_code = ?", tiersCode); err != nil {
+		return err
+	}
+	_, err := q.db.Exec("UPDATE processed_records SET warnings = NULL WHERE tiers_code = ?", tiersCode)
+	return err
+}
+
+func (q sqlQueries) RecordPrivacyRequest(r PrivacyRequest) error {
+	_, err := q.db.Exec(
+		"INSERT INTO privacy_requests (kind, client_hash, operator, reason, details) VALUES (?, ?, ?, ?, ?)",
+		r.Kind, r.ClientHash, r.Operator, r.Reason, []byte(r.Details),
+	)
+	return err
+}
+
+func (q sqlQueries) ListPrivacyRequests(clientHash string) ([]PrivacyRequest, error) {
+	rows, err := q.db.Query(
+		"SELECT id, kind, client_hash, operator, reason, details, created_at FROM privacy_requests WHERE client_hash = ? ORDER BY id",
+		clientHash,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	requests := []PrivacyRequest{}
+	for rows.Next() {
+		r := PrivacyRequest{}
+		var details []byte
+		if err := rows.Scan(&r.ID, &r.Kind, &r.ClientHash, &r.Operator, &r.Reason, &details, &r.CreatedAt); err != nil {
+			return nil, err
+		}
+		if len(details) > 0 {
+			r.Details = details
+		}
+		requests = append(requests, r)
+	}
+	return requests, rows.Err()
+}
+
+func (s *sqlStore) DeleteWebhookEvent(id int64) error {
+	_, err := s.db.Exec("DELETE FROM webhook_events WHERE id = ?", id)
+	return err
+}
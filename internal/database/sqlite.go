@@ -0,0 +1,66 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+// OpenSQLite opens the SQLite database at path, creating it if needed. SQLite
+// suits single node installs: its locks only apply within the process.
+func OpenSQLite(path string) (Store, error) {
+	// writers wait for each other rather than failing, and transactions
+	// take the write lock upfront, as they always end up writing
+	dsn := "file:" + path + "?_pragma=busy_timeout(10000)&_pragma=journal_mode(WAL)&_pragma=foreign_keys(1)&_txlock=immediate"
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		return nil, fmt.Errorf("error opening database: %v", err)
+	}
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("error opening database %s: %v", path, err)
+	}
+	return &sqlStore{sqlQueries: sqlQueries{db: db, dialect: sqliteDialect()}, db: db}, nil
+}
+
+func sqliteDialect() *dialect {
+	locks := localLocks{}
+	return &dialect{
+		migrations:     "migrations/sqlite",
+		now:            "CURRENT_TIMESTAMP",
+		secondsFromNow: "DATETIME('now', ? || ' seconds')",
+		upsertSQL: func(key string, columns ...string) string {
+			set := []string{}
+			for _, c := range columns {
+				set = append(set, c+" = excluded."+c)
+			}
+			return "ON CONFLICT (" + key + ") DO UPDATE SET " + strings.Join(set, ", ")
+		},
+		insertIgnore: "INSERT OR IGNORE",
+		allocate:     sqliteAllocate,
+		// timestamps are stored as text, in UTC
+		time: func(t time.Time) any { return t.UTC().Format(time.DateTime) },
+		lock: func(ctx context.Context, _ *sql.Conn, name string, timeout time.Duration) (func(), error) {
+			return locks.lock(ctx, name, timeout)
+		},
+		missingTable: func(err error) bool {
+			return err != nil && strings.Contains(err.Error(), "no such table")
+		},
+	}
+}
+
+func sqliteAllocate(db DBTX, counter string, n int) (int, error) {
+	var last int
+	err := db.QueryRow(
+		"INSERT INTO counters (name, value) VALUES (?, ?) ON CONFLICT (name) DO UPDATE SET value = value + excluded.value RETURNING value",
+		counter, n,
+	).Scan(&last)
+	if err != nil {
+		return -1, err
+	}
+	return last - n + 1, nil
+}
@@ -0,0 +1,254 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+)
+
+// Queries are the reads and writes of the import pipeline. They run either
+// directly on a Store, or within a Tx.
+type Queries interface {
+	// PeekCounter returns the current value of the counter without creating
+	// it.
+	PeekCounter(counter string) (int, error)
+	// AllocateCounter atomically reserves n consecutive values of the
+	// counter and returns the first one. Within a transaction, a rollback
+	// gives the values back.
+	AllocateCounter(counter string, n int) (int, error)
+
+	IsTransactionProcessed(clientHash, transactionID string) (bool, error)
+	// RecordProcessedTransaction marks the transaction as processed, along
+	// with the tiers code it was imported to and the JSON encoded warnings
+	// raised while importing it. Recording an already processed transaction
+	// again, e.g. on a forced replay, refreshes the record.
+	RecordProcessedTransaction(clientHash, transactionID, tiersCode string, warnings []byte) error
+	// GetProcessedTransaction returns nil when the transaction was never
+	// processed.
+	GetProcessedTransaction(clientHash, transactionID string) (*ProcessedRecord, error)
+	// MarkTransactionReversed records that the transaction was refunded or
+	// cancelled. It returns false when it already was.
+	MarkTransactionReversed(clientHash, transactionID string) (bool, error)
+	// CustomerTiersCode returns the tiers code the customer was last
+	// imported to, or an empty string for a new customer. When code is
+	// given, it is only returned if it belongs to the customer.
+	CustomerTiersCode(clientHash, code string) (string, error)
+	// ClientHashExists reports whether a transaction or a customer was
+	// recorded with the client hash.
+	ClientHashExists(clientHash string) (bool, error)
+	// ClientHashes returns every client hash recorded.
+	ClientHashes() ([]string, error)
+	// RehashClient moves the transactions and customers recorded with the
+	// client hash from to the client hash to. A transaction recorded with
+	// both keeps its record made with to.
+	RehashClient(from, to string) error
+
+	// SaveCustomer creates the customer, or updates its details when the
+	// tiers already exists.
+	SaveCustomer(c Customer) error
+	// FindCustomers returns the customers with the given client hash, or
+	// with the given tiers code when clientHash is empty.
+	FindCustomers(clientHash, tiersCode string) ([]Customer, error)
+
+	AddPass(p Pass) error
+	// ActiveTransactionPasses returns the passes of the transaction that
+	// are still active.
+	ActiveTransactionPasses(transactionID string) ([]Pass, error)
+	// TiersPasses returns every pass issued to the tiers, active or not.
+	TiersPasses(tiersCode string) ([]Pass, error)
+	DeactivateTransactionPasses(transactionID string) error
+	CountActivePasses(tiersCode string) (int, error)
+
+	AddOutboxEntry(transactionID, path string, content []byte) error
+	// PendingOutboxEntries returns the entries not uploaded yet, in
+	// insertion order. An empty transactionID selects the entries of every
+	// transaction created more than olderThan ago.
+	PendingOutboxEntries(transactionID string, olderThan time.Duration) ([]OutboxEntry, error)
+	MarkOutboxUploaded(id int64) error
+	MarkOutboxFailedAttempt(id int64, cause error) error
+	// LatestOutboxContent returns the content of the latest object named
+	// either base.json or base_*.json, or nil if there is none.
+	LatestOutboxContent(base string) ([]byte, error)
+
+	// ClientTransactions returns the transactions recorded with the client
+	// hash.
+	ClientTransactions(clientHash string) ([]ProcessedRecord, error)
+	// TransactionOutboxEntries returns every outbox entry of the
+	// transaction, uploaded or not.
+	TransactionOutboxEntries(transactionID string) ([]OutboxEntry, error)
+	DeleteTransactionOutboxEntries(transactionID string) error
+	// AnonymizeTiers deletes the customer of the tiers, and clears the
+	// plates of its passes and the warnings of its transactions.
+	AnonymizeTiers(tiersCode string) error
+	RecordPrivacyRequest(r PrivacyRequest) error
+	ListPrivacyRequests(clientHash string) ([]PrivacyRequest, error)
+}
+
+// Tx is a transaction started with Store.Begin.
+type Tx interface {
+	Queries
+	Commit() error
+	// Rollback discards the transaction unless it was committed, and
+	// releases its lock. It must always be called, even after Commit.
+	Rollback() error
+}
+
+// Store keeps the state of the importer.
+type Store interface {
+	Queries
+
+	// QueueWebhookEvent stores a webhook payload and claims it for lease,
+	// see ClaimWebhookEvent. Payloads delivered again by Payrexx are not
+	// stored twice: the existing event is claimed instead, unless it is
+	// done, parked or still claimed by someone else. The returned bool
+	// tells whether the event was claimed.
+	QueueWebhookEvent(transactionUUID string, payload []byte, lease time.Duration) (*WebhookEvent, bool, error)
+	// ClaimWebhookEvent marks the oldest due event as processing and
+	// returns it. An event stays claimed for lease, after which it is
+	// considered abandoned and can be claimed again. It returns nil when no
+	// event is due.
+	ClaimWebhookEvent(lease time.Duration) (*WebhookEvent, error)
+	// ReclaimWebhookEvent claims the given event for lease whatever its
+	// status, e.g. to replay it. It returns false, leaving ev unchanged,
+	// when the event changed since it was read or is claimed by someone
+	// else.
+	ReclaimWebhookEvent(ev *WebhookEvent, lease time.Duration) (bool, error)
+	CompleteWebhookEvent(id int64) error
+	// RetryWebhookEvent puts the event back in the queue, to be processed
+	// again after delay.
+	RetryWebhookEvent(id int64, cause error, delay time.Duration) error
+	FailWebhookEvent(id int64, cause error) error
+	// RejectWebhookEvent marks the event as impossible to import.
+	RejectWebhookEvent(id int64, cause error) error
+	// ReviewWebhookEvent parks the event until an operator approves it.
+	ReviewWebhookEvent(id int64, cause error) error
+	SetWebhookEventOverrides(id int64, overrides []byte) error
+	// GetWebhookEvent returns nil when there is no such event.
+	GetWebhookEvent(id int64) (*WebhookEvent, error)
+	ListWebhookEvents(filter EventFilter) ([]WebhookEvent, error)
+	DeleteWebhookEvent(id int64) error
+
+	// Begin starts a transaction once it holds the named lock, waiting at
+	// most timeout for it. Locks are shared by every process using the
+	// store, and held until Rollback.
+	Begin(ctx context.Context, lock string, timeout time.Duration) (Tx, error)
+
+	// Migrate applies the pending schema migrations.
+	Migrate(ctx context.Context) error
+	// MigrationStatuses lists the schema migrations and whether they were
+	// applied, without changing anything.
+	MigrationStatuses(ctx context.Context) ([]MigrationStatus, error)
+
+	Ping(ctx context.Context) error
+	Close() error
+}
+
+// Backends selected with DATABASE_BACKEND.
+const (
+	BackendMariaDB = "mariadb"
+	BackendSQLite  = "sqlite"
+	BackendMemory  = "memory"
+)
+
+// Open opens the store selected with DATABASE_BACKEND: MariaDB by default,
+// see OpenMariaDB, SQLite at SQLITE_PATH, see OpenSQLite, or memory, whose
+// data is lost on exit.
+func Open() (Store, error) {
+	switch backend := os.Getenv("DATABASE_BACKEND"); backend {
+	case "", BackendMariaDB:
+		return OpenMariaDB()
+	case BackendSQLite:
+		path := os.Getenv("SQLITE_PATH")
+		if path == "" {
+			path = "importer.db"
+		}
+		return OpenSQLite(path)
+	case BackendMemory:
+		return NewMemory(), nil
+	default:
+		return nil, fmt.Errorf("unknown DATABASE_BACKEND %q, expected mariadb, sqlite or memory", backend)
+	}
+}
+
+// InitDB opens the store and applies the pending migrations, see Open.
+func InitDB(ctx context.Context) (Store, error) {
+	store, err := Open()
+	if err != nil {
+		return nil, err
+	}
+	if err := store.Migrate(ctx); err != nil {
+		store.Close()
+		return nil, err
+	}
+	return store, nil
+}
+
+// sqlStore implements Store with database/sql, for the SQL dialect of the
+// database.
+type sqlStore struct {
+	sqlQueries
+	db *sql.DB
+}
+
+func (s *sqlStore) Begin(ctx context.Context, lock string, timeout time.Duration) (Tx, error) {
+	if err := checkLockName(lock); err != nil {
+		return nil, err
+	}
+	conn, err := s.db.Conn(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get a database connection: %w", err)
+	}
+	unlock, err := s.dialect.lock(ctx, conn, lock, timeout)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		unlock()
+		conn.Close()
+		return nil, fmt.Errorf("unable to start database transaction: %w", err)
+	}
+	return &sqlTx{
+		sqlQueries: sqlQueries{db: tx, dialect: s.dialect},
+		tx:         tx,
+		release: func() {
+			unlock()
+			conn.Close()
+		},
+	}, nil
+}
+
+func (s *sqlStore) Ping(ctx context.Context) error {
+	return s.db.PingContext(ctx)
+}
+
+func (s *sqlStore) Close() error {
+	return s.db.Close()
+}
+
+type sqlTx struct {
+	sqlQueries
+	tx      *sql.Tx
+	release func()
+}
+
+func (t *sqlTx) Commit() error {
+	return t.tx.Commit()
+}
+
+func (t *sqlTx) Rollback() error {
+	err := t.tx.Rollback()
+	if t.release != nil {
+		t.release()
+		t.release = nil
+	}
+	if errors.Is(err, sql.ErrTxDone) {
+		return nil
+	}
+	return err
+}
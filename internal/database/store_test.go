@@ -0,0 +1,427 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/clementnuss/truckflow-user-importer/internal/failure"
+	"github.com/go-sql-driver/mysql"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// openMariaDBTest opens a disposable database created on the MariaDB server
+// given by MARIADB_TEST_DSN, e.g. root:secret@tcp(localhost:3306)/
+func openMariaDBTest(t *testing.T) Store {
+	dsn := os.Getenv("MARIADB_TEST_DSN")
+	if dsn == "" {
+		t.Skip("MARIADB_TEST_DSN is not set")
+	}
+
+	cfg, err := mysql.ParseDSN(dsn)
+	require.NoError(t, err)
+	cfg.ParseTime = true
+	admin, err := sql.Open("mysql", cfg.FormatDSN())
+	require.NoError(t, err)
+	t.Cleanup(func() { admin.Close() })
+
+	cfg.DBName = fmt.Sprintf("importer_test_%d", time.Now().UnixNano())
+	_, err = admin.Exec("CREATE DATABASE " + cfg.DBName)
+	require.NoError(t, err)
+	t.Cleanup(func() { admin.Exec("DROP DATABASE " + cfg.DBName) })
+
+	db, err := sql.Open("mysql", cfg.FormatDSN())
+	require.NoError(t, err)
+	store := NewMariaDB(db)
+	t.Cleanup(func() { store.Close() })
+	return store
+}
+
+func openSQLiteTest(t *testing.T) Store {
+	store, err := OpenSQLite(filepath.Join(t.TempDir(), "importer.db"))
+	require.NoError(t, err)
+	t.Cleanup(func() { store.Close() })
+	return store
+}
+
+// forEachStore runs test against every backend, migrated.
+func forEachStore(t *testing.T, test func(t *testing.T, store Store)) {
+	for name, open := range map[string]func(t *testing.T) Store{
+		BackendMariaDB: openMariaDBTest,
+		BackendSQLite:  openSQLiteTest,
+		BackendMemory:  func(t *testing.T) Store { return NewMemory() },
+	} {
+		t.Run(name, func(t *testing.T) {
+			store := open(t)
+			require.NoError(t, store.Migrate(context.Background()))
+			test(t, store)
+		})
+	}
+}
+
+func TestCounters(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		v, err := store.PeekCounter("pass")
+		require.NoError(t, err)
+		assert.Equal(t, 0, v)
+
+		first, err := store.AllocateCounter("pass", 2)
+		require.NoError(t, err)
+		assert.Equal(t, 1, first)
+		first, err = store.AllocateCounter("pass", 3)
+		require.NoError(t, err)
+		assert.Equal(t, 3, first)
+
+		// a rollback gives the values back
+		tx, err := store.Begin(context.Background(), "test", time.Second)
+		require.NoError(t, err)
+		first, err = tx.AllocateCounter("pass", 1)
+		require.NoError(t, err)
+		assert.Equal(t, 6, first)
+		require.NoError(t, tx.Rollback())
+
+		v, err = store.PeekCounter("pass")
+		require.NoError(t, err)
+		assert.Equal(t, 5, v)
+	})
+}
+
+func TestProcessedRecords(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		processed, err := store.IsTransactionProcessed("hash", "tr1")
+		require.NoError(t, err)
+		assert.False(t, processed)
+
+		require.NoError(t, store.RecordProcessedTransaction("hash", "tr1", "00001", nil))
+		require.NoError(t, store.RecordProcessedTransaction("hash", "tr2", "00002", []byte(`[]`)))
+		// a forced replay refreshes the record
+		require.NoError(t, store.RecordProcessedTransaction("hash", "tr1", "00001", nil))
+
+		processed, err = store.IsTransactionProcessed("hash", "tr1")
+		require.NoError(t, err)
+		assert.True(t, processed)
+
+		code, err := store.CustomerTiersCode("hash", "")
+		require.NoError(t, err)
+		assert.Contains(t, []string{"00001", "00002"}, code)
+		code, err = store.CustomerTiersCode("hash", "00002")
+		require.NoError(t, err)
+		assert.Equal(t, "00002", code)
+		code, err = store.CustomerTiersCode("other", "")
+		require.NoError(t, err)
+		assert.Equal(t, "", code)
+
+		reversed, err := store.MarkTransactionReversed("hash", "tr2")
+		require.NoError(t, err)
+		assert.True(t, reversed)
+		reversed, err = store.MarkTransactionReversed("hash", "tr2")
+		require.NoError(t, err)
+		assert.False(t, reversed)
+
+		rec, err := store.GetProcessedTransaction("hash", "tr2")
+		require.NoError(t, err)
+		assert.Equal(t, &ProcessedRecord{ClientHash: "hash", TransactionID: "tr2", TiersCode: "00002", Reversed: true}, rec)
+		rec, err = store.GetProcessedTransaction("hash", "tr3")
+		require.NoError(t, err)
+		assert.Nil(t, rec)
+	})
+}
+
+func TestRehashClient(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		require.NoError(t, store.RecordProcessedTransaction("old", "tr1", "00001", nil))
+		require.NoError(t, store.RecordProcessedTransaction("old", "tr2", "00001", nil))
+		require.NoError(t, store.RecordProcessedTransaction("k1:new", "tr2", "00001", nil))
+		require.NoError(t, store.SaveCustomer(Customer{TiersCode: "00001", ClientHash: "old", Label: "John Doe"}))
+
+		hashes, err := store.ClientHashes()
+		require.NoError(t, err)
+		assert.ElementsMatch(t, []string{"old", "k1:new"}, hashes)
+
+		// a rollback keeps the old hash
+		tx, err := store.Begin(context.Background(), "k1:new", time.Second)
+		require.NoError(t, err)
+		require.NoError(t, tx.RehashClient("old", "k1:new"))
+		require.NoError(t, tx.Rollback())
+		exists, err := store.ClientHashExists("old")
+		require.NoError(t, err)
+		assert.True(t, exists)
+
+		require.NoError(t, store.RehashClient("old", "k1:new"))
+		exists, err = store.ClientHashExists("old")
+		require.NoError(t, err)
+		assert.False(t, exists)
+		hashes, err = store.ClientHashes()
+		require.NoError(t, err)
+		assert.Equal(t, []string{"k1:new"}, hashes)
+
+		for _, tr := range []string{"tr1", "tr2"} {
+			processed, err := store.IsTransactionProcessed("k1:new", tr)
+			require.NoError(t, err)
+			assert.True(t, processed, tr)
+		}
+		customers, err := store.FindCustomers("k1:new", "")
+		require.NoError(t, err)
+		assert.Len(t, customers, 1)
+	})
+}
+
+func TestCustomersAndPasses(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		c := Customer{TiersCode: "00001", ClientHash: "hash", Label: "John Doe", ClientType: 1, City: "Delémont"}
+		require.NoError(t, store.SaveCustomer(c))
+		c.City = "Porrentruy"
+		require.NoError(t, store.SaveCustomer(c))
+
+		customers, err := store.FindCustomers("hash", "")
+		require.NoError(t, err)
+		require.Len(t, customers, 1)
+		assert.Equal(t, "Porrentruy", customers[0].City)
+		assert.False(t, customers[0].CreatedAt.IsZero())
+		customers, err = store.FindCustomers("", "00001")
+		require.NoError(t, err)
+		assert.Len(t, customers, 1)
+
+		for _, code := range []string{"P2", "P1"} {
+			require.NoError(t, store.AddPass(Pass{ParkCode: code, Plate: "JU1", TiersCode: "00001", TransactionID: "tr1"}))
+		}
+		require.NoError(t, store.AddPass(Pass{ParkCode: "P3", Plate: "JU1", TiersCode: "00001", TransactionID: "tr2"}))
+		assert.Error(t, store.AddPass(Pass{ParkCode: "P3", TiersCode: "00001", TransactionID: "tr2"}))
+
+		passes, err := store.ActiveTransactionPasses("tr1")
+		require.NoError(t, err)
+		require.Len(t, passes, 2)
+		assert.Equal(t, "P1", passes[0].ParkCode)
+		assert.True(t, passes[0].Active)
+
+		require.NoError(t, store.DeactivateTransactionPasses("tr1"))
+		n, err := store.CountActivePasses("00001")
+		require.NoError(t, err)
+		assert.Equal(t, 1, n)
+		passes, err = store.TiersPasses("00001")
+		require.NoError(t, err)
+		assert.Len(t, passes, 3)
+	})
+}
+
+func TestOutbox(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		require.NoError(t, store.AddOutboxEntry("tr1", "importer/tiers_import_00001.json", []byte("first")))
+		require.NoError(t, store.AddOutboxEntry("tr2", "importer/tiers_import_00001_tr2.json", []byte("second")))
+		require.NoError(t, store.AddOutboxEntry("tr2", "importer/pass_import_00001_tr2.json", []byte("pass")))
+
+		entries, err := store.PendingOutboxEntries("tr2", 0)
+		require.NoError(t, err)
+		require.Len(t, entries, 2)
+		assert.Equal(t, "importer/tiers_import_00001_tr2.json", entries[0].Path)
+
+		require.NoError(t, store.MarkOutboxFailedAttempt(entries[0].ID, errors.New("unavailable")))
+		require.NoError(t, store.MarkOutboxUploaded(entries[1].ID))
+
+		entries, err = store.PendingOutboxEntries("", 0)
+		require.NoError(t, err)
+		require.Len(t, entries, 2)
+		assert.Equal(t, 1, entries[1].Attempts)
+		entries, err = store.PendingOutboxEntries("", time.Hour)
+		require.NoError(t, err)
+		assert.Empty(t, entries)
+
+		content, err := store.LatestOutboxContent("importer/tiers_import_00001")
+		require.NoError(t, err)
+		assert.Equal(t, "second", string(content))
+		content, err = store.LatestOutboxContent("importer/tiers_import_00002")
+		require.NoError(t, err)
+		assert.Nil(t, content)
+	})
+}
+
+func TestWebhookEvents(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		ev, claimed, err := store.QueueWebhookEvent("tr1", []byte(`{"a":1}`), time.Minute)
+		require.NoError(t, err)
+		assert.True(t, claimed)
+		assert.Equal(t, EventProcessing, ev.Status)
+
+		// a redelivery of an event being processed is not claimed again
+		again, claimed, err := store.QueueWebhookEvent("tr1", []byte(`{"a":1}`), time.Minute)
+		require.NoError(t, err)
+		assert.False(t, claimed)
+		assert.Equal(t, ev.ID, again.ID)
+
+		next, err := store.ClaimWebhookEvent(time.Minute)
+		require.NoError(t, err)
+		assert.Nil(t, next)
+		claimed, err = store.ReclaimWebhookEvent(again, time.Minute)
+		require.NoError(t, err)
+		assert.False(t, claimed)
+
+		require.NoError(t, store.RetryWebhookEvent(ev.ID, errors.New("unavailable"), 0))
+		next, err = store.ClaimWebhookEvent(time.Minute)
+		require.NoError(t, err)
+		require.NotNil(t, next)
+		assert.Equal(t, ev.ID, next.ID)
+		assert.Equal(t, 2, next.Attempts)
+		assert.Equal(t, "unavailable", next.LastError)
+
+		require.NoError(t, store.ReviewWebhookEvent(ev.ID, errors.New("no plate given")))
+		require.NoError(t, store.SetWebhookEventOverrides(ev.ID, []byte(`{"plates":"JU1"}`)))
+		got, err := store.GetWebhookEvent(ev.ID)
+		require.NoError(t, err)
+		assert.Equal(t, EventPendingReview, got.Status)
+		assert.Equal(t, `{"plates":"JU1"}`, string(got.Overrides))
+		assert.Equal(t, `{"a":1}`, string(got.Payload))
+
+		// an event is claimed once, whatever its status
+		stale := *got
+		claimed, err = store.ReclaimWebhookEvent(got, time.Minute)
+		require.NoError(t, err)
+		assert.True(t, claimed)
+		assert.Equal(t, EventProcessing, got.Status)
+		assert.Equal(t, 3, got.Attempts)
+		claimed, err = store.ReclaimWebhookEvent(&stale, time.Minute)
+		require.NoError(t, err)
+		assert.False(t, claimed)
+		require.NoError(t, store.ReviewWebhookEvent(ev.ID, errors.New("no plate given")))
+
+		other, _, err := store.QueueWebhookEvent("tr2", []byte(`{"a":2}`), time.Minute)
+		require.NoError(t, err)
+		require.NoError(t, store.CompleteWebhookEvent(other.ID))
+
+		events, err := store.ListWebhookEvents(EventFilter{From: time.Now().Add(-time.Hour)})
+		require.NoError(t, err)
+		assert.Len(t, events, 2)
+		events, err = store.ListWebhookEvents(EventFilter{Status: EventDone})
+		require.NoError(t, err)
+		require.Len(t, events, 1)
+		assert.Equal(t, "tr2", events[0].TransactionUUID)
+		events, err = store.ListWebhookEvents(EventFilter{To: time.Now().Add(-time.Hour)})
+		require.NoError(t, err)
+		assert.Empty(t, events)
+
+		got, err = store.GetWebhookEvent(1000)
+		require.NoError(t, err)
+		assert.Nil(t, got)
+	})
+}
+
+func TestQueueWebhookEventConcurrently(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		claims := make(chan bool, 8)
+		for range cap(claims) {
+			go func() {
+				_, claimed, err := store.QueueWebhookEvent("tr1", []byte(`{"a":1}`), time.Minute)
+				assert.NoError(t, err)
+				claims <- claimed
+			}()
+		}
+		claimed := 0
+		for range cap(claims) {
+			if <-claims {
+				claimed += 1
+			}
+		}
+		assert.Equal(t, 1, claimed)
+
+		events, err := store.ListWebhookEvents(EventFilter{TransactionUUID: "tr1"})
+		require.NoError(t, err)
+		assert.Len(t, events, 1)
+	})
+}
+
+func TestBeginLock(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		ctx := context.Background()
+		tx, err := store.Begin(ctx, "customer", time.Second)
+		require.NoError(t, err)
+		require.NoError(t, tx.RecordProcessedTransaction("hash", "tr1", "00001", nil))
+		require.NoError(t, tx.Commit())
+
+		// the lock is held until Rollback, even after Commit
+		_, err = store.Begin(ctx, "customer", 0)
+		assert.ErrorIs(t, err, ErrLockTimeout)
+		require.NoError(t, tx.Rollback())
+
+		tx, err = store.Begin(ctx, "customer", time.Second)
+		require.NoError(t, err)
+		require.NoError(t, tx.Rollback())
+
+		processed, err := store.IsTransactionProcessed("hash", "tr1")
+		require.NoError(t, err)
+		assert.True(t, processed)
+
+		// GET_LOCK rejects longer names
+		_, err = store.Begin(ctx, strings.Repeat("x", MaxLockName+1), time.Second)
+		assert.Error(t, err)
+	})
+}
+
+func TestSQLiteErrorKind(t *testing.T) {
+	store := openSQLiteTest(t)
+	require.NoError(t, store.Migrate(context.Background()))
+
+	require.NoError(t, store.AddPass(Pass{ParkCode: "P1"}))
+	err := store.AddPass(Pass{ParkCode: "P1"})
+	assert.Equal(t, failure.Permanent, ErrorKind(err))
+}
+
+func TestPrivacy(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		require.NoError(t, store.RecordProcessedTransaction("hash", "tr1", "00001", []byte(`[{"plate":"JU1"}]`)))
+		require.NoError(t, store.RecordProcessedTransaction("other", "tr2", "00002", nil))
+		require.NoError(t, store.SaveCustomer(Customer{TiersCode: "00001", ClientHash: "hash", Label: "John Doe"}))
+		require.NoError(t, store.AddPass(Pass{ParkCode: "P1", Plate: "JU1", TiersCode: "00001", TransactionID: "tr1"}))
+		require.NoError(t, store.AddOutboxEntry("tr1", "importer/tiers_import_00001.json", []byte("tiers")))
+		require.NoError(t, store.AddOutboxEntry("tr2", "importer/tiers_import_00002.json", []byte("other")))
+
+		records, err := store.ClientTransactions("hash")
+		require.NoError(t, err)
+		assert.Equal(t, []ProcessedRecord{{ClientHash: "hash", TransactionID: "tr1", TiersCode: "00001"}}, records)
+		entries, err := store.TransactionOutboxEntries("tr1")
+		require.NoError(t, err)
+		require.Len(t, entries, 1)
+		assert.Equal(t, "tiers", string(entries[0].Content))
+
+		require.NoError(t, store.DeleteTransactionOutboxEntries("tr1"))
+		require.NoError(t, store.AnonymizeTiers("00001"))
+		entries, err = store.TransactionOutboxEntries("tr1")
+		require.NoError(t, err)
+		assert.Empty(t, entries)
+		customers, err := store.FindCustomers("hash", "")
+		require.NoError(t, err)
+		assert.Empty(t, customers)
+		passes, err := store.TiersPasses("00001")
+		require.NoError(t, err)
+		require.Len(t, passes, 1)
+		assert.Equal(t, "", passes[0].Plate)
+		// the records stay, so that the transaction is never imported again
+		processed, err := store.IsTransactionProcessed("hash", "tr1")
+		require.NoError(t, err)
+		assert.True(t, processed)
+		content, err := store.LatestOutboxContent("importer/tiers_import_00002")
+		require.NoError(t, err)
+		assert.Equal(t, "other", string(content))
+
+		require.NoError(t, store.RecordPrivacyRequest(PrivacyRequest{Kind: PrivacyErase, ClientHash: "hash", Operator: "admin", Details: []byte(`{"tiers":["00001"]}`)}))
+		requests, err := store.ListPrivacyRequests("hash")
+		require.NoError(t, err)
+		require.Len(t, requests, 1)
+		assert.Equal(t, PrivacyErase, requests[0].Kind)
+		assert.Equal(t, "admin", requests[0].Operator)
+		assert.JSONEq(t, `{"tiers":["00001"]}`, string(requests[0].Details))
+		assert.False(t, requests[0].CreatedAt.IsZero())
+
+		ev, _, err := store.QueueWebhookEvent("tr1", []byte(`{}`), time.Minute)
+		require.NoError(t, err)
+		require.NoError(t, store.DeleteWebhookEvent(ev.ID))
+		got, err := store.GetWebhookEvent(ev.ID)
+		require.NoError(t, err)
+		assert.Nil(t, got)
+	})
+}
@@ -0,0 +1,68 @@
+package failure
+
+import "errors"
+
+// Kind tells whether retrying an operation may succeed.
+type Kind int
+
+const (
+	// Unknown errors are not classified. Callers should err on the side of
+	// retrying them.
+	Unknown Kind = iota
+	// Permanent errors fail again whatever the number of attempts, e.g. an
+	// invalid transaction.
+	Permanent
+	// Transient errors are expected to go away, e.g. a database or S3 outage.
+	Transient
+)
+
+func (k Kind) String() string {
+	switch k {
+	case Permanent:
+		return "permanent"
+	case Transient:
+		return "transient"
+	default:
+		return "unknown"
+	}
+}
+
+// Error is an error of a known Kind.
+type Error struct {
+	Kind Kind
+	Err  error
+}
+
+func (e *Error) Error() string {
+	return e.Err.Error()
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// NewPermanent marks err as permanent. It returns nil if err is nil.
+func NewPermanent(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &Error{Kind: Permanent, Err: err}
+}
+
+// NewTransient marks err as transient. It returns nil if err is nil.
+func NewTransient(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &Error{Kind: Transient, Err: err}
+}
+
+// KindOf returns the kind of the outermost classified error in the chain of
+// err.
+func KindOf(err error) Kind {
+	var e *Error
+	if errors.As(err, &e) {
+		return e.Kind
+	}
+	return Unknown
+}
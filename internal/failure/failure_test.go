@@ -0,0 +1,22 @@
+package failure_test
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/clementnuss/truckflow-user-importer/internal/failure"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestKindOf(t *testing.T) {
+	cause := errors.New("boom")
+
+	assert.Equal(t, failure.Unknown, failure.KindOf(cause))
+	assert.Equal(t, failure.Permanent, failure.KindOf(failure.NewPermanent(cause)))
+	assert.Equal(t, failure.Transient, failure.KindOf(fmt.Errorf("upload: %w", failure.NewTransient(cause))))
+	assert.True(t, errors.Is(failure.NewTransient(cause), cause))
+
+	assert.Nil(t, failure.NewPermanent(nil))
+	assert.Nil(t, failure.NewTransient(nil))
+}
@@ -0,0 +1,128 @@
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Check reports whether a dependency is usable.
+type Check func(ctx context.Context) error
+
+// Pinger is a database that can be pinged.
+type Pinger interface {
+	Ping(ctx context.Context) error
+}
+
+// DatabaseCheck pings the database.
+func DatabaseCheck(db Pinger) Check {
+	return db.Ping
+}
+
+// Cached reuses the result of check for ttl.
+func Cached(check Check, ttl time.Duration) Check {
+	mu := sync.Mutex{}
+	var checked time.Time
+	var result error
+	return func(ctx context.Context) error {
+		mu.Lock()
+		defer mu.Unlock()
+		if time.Since(checked) < ttl {
+			return result
+		}
+		result = check(ctx)
+		checked = time.Now()
+		return result
+	}
+}
+
+type namedCheck struct {
+	name  string
+	check Check
+}
+
+// Checker serves the liveness and readiness probes.
+type Checker struct {
+	// Timeout bounds each check.
+	Timeout time.Duration
+	// Grace is how long the dependencies may stay down before the liveness
+	// probe fails, so that the pod gets restarted.
+	Grace time.Duration
+
+	checks []namedCheck
+
+	mu        sync.Mutex
+	downSince time.Time
+	now       func() time.Time
+}
+
+func NewChecker() *Checker {
+	return &Checker{
+		Timeout: 2 * time.Second,
+		Grace:   5 * time.Minute,
+		now:     time.Now,
+	}
+}
+
+// Add registers a dependency check.
+func (c *Checker) Add(name string, check Check) {
+	c.checks = append(c.checks, namedCheck{name, check})
+}
+
+// check runs every check and returns the status of each dependency, and
+// whether they are all up.
+func (c *Checker) check(ctx context.Context) (map[string]string, bool) {
+	ctx, cancel := context.WithTimeout(ctx, c.Timeout)
+	defer cancel()
+
+	status := map[string]string{}
+	ok := true
+	for _, nc := range c.checks {
+		status[nc.name] = "ok"
+		if err := nc.check(ctx); err != nil {
+			slog.Warn("dependency check failed", "dependency", nc.name, "error", err)
+			status[nc.name] = err.Error()
+			ok = false
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if ok {
+		c.downSince = time.Time{}
+	} else if c.downSince.IsZero() {
+		c.downSince = c.now()
+	}
+	return status, ok
+}
+
+// Ready answers 503 as long as a dependency is down, so that no webhook is
+// routed to the pod.
+func (c *Checker) Ready(w http.ResponseWriter, r *http.Request) {
+	status, ok := c.check(r.Context())
+	code := http.StatusOK
+	if !ok {
+		code = http.StatusServiceUnavailable
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(status)
+}
+
+// Live answers 503 once the dependencies stayed down for longer than Grace.
+func (c *Checker) Live(w http.ResponseWriter, r *http.Request) {
+	c.check(r.Context())
+
+	c.mu.Lock()
+	down := !c.downSince.IsZero() && c.now().Sub(c.downSince) > c.Grace
+	c.mu.Unlock()
+
+	if down {
+		http.Error(w, "dependencies down for too long", http.StatusServiceUnavailable)
+		return
+	}
+	_, _ = w.Write([]byte("ok"))
+}
@@ -0,0 +1,53 @@
+package health
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCached(t *testing.T) {
+	calls := 0
+	check := Cached(func(context.Context) error {
+		calls += 1
+		return nil
+	}, time.Hour)
+
+	assert.NoError(t, check(context.Background()))
+	assert.NoError(t, check(context.Background()))
+	assert.Equal(t, 1, calls)
+}
+
+func TestChecker(t *testing.T) {
+	now := time.Date(2025, 1, 27, 22, 0, 0, 0, time.UTC)
+	var dbErr error
+
+	c := NewChecker()
+	c.now = func() time.Time { return now }
+	c.Add("database", func(context.Context) error { return dbErr })
+
+	probe := func(handler http.HandlerFunc) int {
+		rec := httptest.NewRecorder()
+		handler(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+		return rec.Code
+	}
+
+	assert.Equal(t, http.StatusOK, probe(c.Ready))
+	assert.Equal(t, http.StatusOK, probe(c.Live))
+
+	dbErr = errors.New("connection refused")
+	assert.Equal(t, http.StatusServiceUnavailable, probe(c.Ready))
+	assert.Equal(t, http.StatusOK, probe(c.Live))
+
+	now = now.Add(c.Grace + time.Second)
+	assert.Equal(t, http.StatusServiceUnavailable, probe(c.Live))
+
+	dbErr = nil
+	assert.Equal(t, http.StatusOK, probe(c.Live))
+	assert.Equal(t, http.StatusOK, probe(c.Ready))
+}
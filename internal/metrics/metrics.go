@@ -0,0 +1,94 @@
+package metrics
+
+import (
+	"log/slog"
+	"math"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const namespace = "truckflow_importer"
+
+var (
+	// Webhooks counts the webhooks received, by the status of the answer.
+	Webhooks = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "webhooks_total",
+		Help:      "Webhooks received, by status of the answer.",
+	}, []string{"status"})
+
+	TiersCreated = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "tiers_created_total",
+		Help:      "Truckflow tiers created for new customers.",
+	})
+
+	PassesCreated = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "passes_created_total",
+		Help:      "Truckflow passes created.",
+	})
+
+	DuplicatesSkipped = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "duplicates_skipped_total",
+		Help:      "Transactions skipped as they were already processed.",
+	})
+
+	ValidationRejects = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "validation_rejects_total",
+		Help:      "Transactions parked for review as they failed validation.",
+	})
+
+	UploadDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "upload_duration_seconds",
+		Help:      "Duration of the uploads of import files to the sink.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"result"})
+
+	DBQueryDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "db_query_duration_seconds",
+		Help:      "Duration of the database queries, by query.",
+		Buckets:   []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30},
+	}, []string{"query"})
+)
+
+// ObserveDBQuery records the duration of the query started at start. It is
+// meant to be deferred.
+func ObserveDBQuery(query string, start time.Time) {
+	DBQueryDuration.WithLabelValues(query).Observe(time.Since(start).Seconds())
+}
+
+// ObserveUpload records the duration of the upload started at start.
+func ObserveUpload(start time.Time, err error) {
+	result := "success"
+	if err != nil {
+		result = "error"
+	}
+	UploadDuration.WithLabelValues(result).Observe(time.Since(start).Seconds())
+}
+
+// RegisterCounters exposes the current value of the named code counters, as
+// returned by read on every scrape.
+func RegisterCounters(read func(name string) (int, error), names ...string) {
+	for _, name := range names {
+		promauto.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace:   namespace,
+			Name:        "counter_value",
+			Help:        "Current value of the code counters.",
+			ConstLabels: prometheus.Labels{"name": name},
+		}, func() float64 {
+			v, err := read(name)
+			if err != nil {
+				slog.Warn("unable to read counter", "counter", name, "error", err)
+				return math.NaN()
+			}
+			return float64(v)
+		})
+	}
+}
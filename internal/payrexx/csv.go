@@ -4,6 +4,8 @@ import (
 	"encoding/csv"
 	"io"
 	"os"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/gocarina/gocsv"
@@ -12,7 +14,7 @@ import (
 
 // Convert the CSV string as internal date
 func (date *DateTime) UnmarshalCSV(csv string) (err error) {
-	date.Time, err = time.Parse("2006-01-02 15:04:05", csv)
+	date.Time, err = time.ParseInLocation("2006-01-02 15:04:05", csv, location)
 	return err
 }
 
@@ -49,3 +51,40 @@ func ParseCSV(file *os.File) ([]CSVTransaction, error) {
 
 	return transactions, nil
 }
+
+// Transaction converts an exported row to the sanitized transaction the
+// webhook would have delivered for it. The export has neither products nor
+// client type: the row is taken as Number badges of product, bought by a
+// company when the company column is filled. Nor has it the uuid of the
+// transaction, its number is used instead.
+func (c CSVTransaction) Transaction(product Product, known func(Product) bool) (Transaction, error) {
+	product.Quantity = c.Number
+	id, _ := strconv.Atoi(strings.TrimSpace(c.Id))
+
+	tr := Transaction{
+		ID:     id,
+		Uuid:   c.Id,
+		Time:   c.Date,
+		Status: strings.ToLower(strings.TrimSpace(c.Status)),
+		Invoice: Invoice{
+			Products: []Product{product},
+		},
+		Contact: Contact{
+			FirstName:   c.FirstName,
+			LastName:    c.LastName,
+			StreetAndNo: c.StreeAndNo,
+			ZIPCode:     c.ZIPCode,
+			City:        c.City,
+			Country:     c.Country,
+			Telephone:   c.Telephone,
+			Email:       c.Email,
+		},
+	}
+
+	err := tr.Sanitize(Fields{
+		Plates:       c.PlateNumbers,
+		ClientNumber: c.ClientNumber,
+		Company:      c.Company,
+	}, known)
+	return tr, err
+}
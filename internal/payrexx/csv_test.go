@@ -0,0 +1,31 @@
+package payrexx_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/clementnuss/truckflow-user-importer/internal/payrexx"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// parseExport parses testdata/export.csv, a Payrexx export whose rows match
+// the webhook payloads of webhook.TestWebhookAndCSVAgree.
+func parseExport(t *testing.T) []payrexx.CSVTransaction {
+	f, err := os.Open(filepath.Join("testdata", "export.csv"))
+	require.NoError(t, err)
+	defer f.Close()
+
+	transactions, err := payrexx.ParseCSV(f)
+	require.NoError(t, err)
+	require.Len(t, transactions, 3)
+	return transactions
+}
+
+func TestCSVTransactionRejectsUnknownProduct(t *testing.T) {
+	row := parseExport(t)[0]
+
+	_, err := row.Transaction(payrexx.Product{Name: "Donation"}, isBadge)
+	assert.Error(t, err)
+}
@@ -0,0 +1,67 @@
+package payrexx
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"time"
+)
+
+// SignatureHeader carries the HMAC-SHA256 of the raw webhook body, keyed with
+// the API secret of the Payrexx instance.
+const SignatureHeader = "X-Webhook-Signature"
+
+var (
+	ErrMissingSignature = errors.New("missing webhook signature")
+	ErrInvalidSignature = errors.New("invalid webhook signature")
+	ErrStaleTransaction = errors.New("transaction time outside of tolerance window")
+)
+
+// Sign returns the hex encoded HMAC-SHA256 of body keyed with secret.
+func Sign(body []byte, secret string) string {
+	return hex.EncodeToString(mac(body, secret))
+}
+
+// VerifySignature checks that signature is the HMAC-SHA256 of body keyed with
+// secret. Both hex and base64 encodings of the MAC are accepted.
+func VerifySignature(body []byte, signature, secret string) error {
+	signature = strings.TrimSpace(signature)
+	if signature == "" {
+		return ErrMissingSignature
+	}
+
+	var got []byte
+	if b, err := hex.DecodeString(signature); err == nil {
+		got = b
+	} else if b, err := base64.StdEncoding.DecodeString(signature); err == nil {
+		got = b
+	} else {
+		return ErrInvalidSignature
+	}
+
+	if !hmac.Equal(got, mac(body, secret)) {
+		return ErrInvalidSignature
+	}
+	return nil
+}
+
+// CheckFreshness rejects transactions whose time is further than tolerance
+// away from now. A zero tolerance disables the check.
+func CheckFreshness(t, now time.Time, tolerance time.Duration) error {
+	if tolerance <= 0 {
+		return nil
+	}
+	if d := now.Sub(t); d > tolerance || d < -tolerance {
+		return ErrStaleTransaction
+	}
+	return nil
+}
+
+func mac(body []byte, secret string) []byte {
+	h := hmac.New(sha256.New, []byte(secret))
+	h.Write(body)
+	return h.Sum(nil)
+}
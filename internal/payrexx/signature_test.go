@@ -0,0 +1,35 @@
+package payrexx_test
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"testing"
+	"time"
+
+	"github.com/clementnuss/truckflow-user-importer/internal/payrexx"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVerifySignature(t *testing.T) {
+	body := []byte(`{"transaction":{"uuid":"b63112e9"}}`)
+	secret := "s3cr3t"
+	sig := payrexx.Sign(body, secret)
+	raw, _ := hex.DecodeString(sig)
+
+	assert.NoError(t, payrexx.VerifySignature(body, sig, secret))
+	assert.NoError(t, payrexx.VerifySignature(body, base64.StdEncoding.EncodeToString(raw), secret))
+
+	assert.ErrorIs(t, payrexx.VerifySignature(body, "", secret), payrexx.ErrMissingSignature)
+	assert.ErrorIs(t, payrexx.VerifySignature(body, sig, "other"), payrexx.ErrInvalidSignature)
+	assert.ErrorIs(t, payrexx.VerifySignature([]byte(`{"transaction":{"uuid":"tampered"}}`), sig, secret), payrexx.ErrInvalidSignature)
+	assert.ErrorIs(t, payrexx.VerifySignature(body, "not a signature!", secret), payrexx.ErrInvalidSignature)
+}
+
+func TestCheckFreshness(t *testing.T) {
+	now := time.Date(2025, 1, 27, 22, 8, 58, 0, time.UTC)
+
+	assert.NoError(t, payrexx.CheckFreshness(now.Add(-time.Hour), now, 2*time.Hour))
+	assert.NoError(t, payrexx.CheckFreshness(now.Add(-72*time.Hour), now, 0))
+	assert.ErrorIs(t, payrexx.CheckFreshness(now.Add(-3*time.Hour), now, 2*time.Hour), payrexx.ErrStaleTransaction)
+	assert.ErrorIs(t, payrexx.CheckFreshness(now.Add(3*time.Hour), now, 2*time.Hour), payrexx.ErrStaleTransaction)
+}
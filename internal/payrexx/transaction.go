@@ -1,12 +1,15 @@
 package payrexx
 
 import (
+	"errors"
 	"fmt"
-	"log/slog"
-	"regexp"
 	"slices"
 	"strings"
 	"time"
+	_ "time/tzdata"
+
+	"github.com/clementnuss/truckflow-user-importer/internal/failure"
+	"github.com/clementnuss/truckflow-user-importer/internal/plates"
 )
 
 type Payout struct {
@@ -14,22 +17,42 @@ type Payout struct {
 	Status string `json:"status"`
 }
 type Transaction struct {
+	// ID is the number of the transaction, the # column of the CSV exports.
+	ID      int      `json:"id"`
 	Uuid    string   `json:"uuid"`
 	Time    DateTime `json:"time"`
 	Status  string   `json:"status"`
 	Invoice Invoice  `json:"invoice"`
 	Contact Contact  `json:"contact"`
 	Plates  []string
+	// PlateWarnings are the anomalies found in the plates given by the
+	// customer.
+	PlateWarnings []plates.Warning
+	// ClientNumber is the Truckflow tiers code the customer optionally
+	// provides when buying again.
+	ClientNumber string
 }
 
 type DateTime struct {
 	time.Time
 }
 
+// Payrexx reports transaction times in the local time of the instance, without
+// any zone information.
+var location = loadLocation("Europe/Zurich")
+
+func loadLocation(name string) *time.Location {
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		return time.UTC
+	}
+	return loc
+}
+
 func (date *DateTime) UnmarshalJSON(data []byte) (err error) {
 	d := string(data)
 	d = strings.Trim(d, "\"")
-	date.Time, err = time.Parse("2006-01-02 15:04:05", d)
+	date.Time, err = time.ParseInLocation("2006-01-02 15:04:05", d, location)
 	return err
 }
 
@@ -41,6 +64,7 @@ type Invoice struct {
 
 type Product struct {
 	Name     string `json:"name"`
+	SKU      string `json:"sku"`
 	Price    int    `json:"price"`
 	Quantity int    `json:"quantity"`
 }
@@ -51,6 +75,20 @@ type CustomField struct {
 	Value string `json:"value"`
 }
 
+// Transaction statuses handled by the importer.
+const (
+	StatusConfirmed         = "confirmed"
+	StatusRefunded          = "refunded"
+	StatusPartiallyRefunded = "partially-refunded"
+	StatusCancelled         = "cancelled"
+)
+
+// IsReversal reports whether the status takes back a previously confirmed
+// transaction.
+func IsReversal(status string) bool {
+	return status == StatusRefunded || status == StatusPartiallyRefunded || status == StatusCancelled
+}
+
 type ClientType int
 
 const (
@@ -72,7 +110,51 @@ type Contact struct {
 	ClientType
 }
 
-func (tr *Transaction) SanitizeFields() error {
+// Fields are the order details filled in by the customer, whatever the source
+// of the transaction.
+type Fields struct {
+	Plates       string `json:"plates"`
+	ClientNumber string `json:"client_number"`
+	Company      string `json:"company"`
+	// ClientType is either "entreprise" or "particulier". When empty, it is
+	// derived from Company.
+	ClientType string `json:"client_type"`
+}
+
+// CustomFields extracts the order details from the custom fields of the
+// Payrexx form.
+func (tr *Transaction) CustomFields() Fields {
+	f := Fields{}
+	for _, cf := range tr.Invoice.CustomFields {
+		switch {
+		case strings.Contains(cf.Name, "Numéros de plaques"):
+			f.Plates = cf.Value
+
+		case strings.Contains(cf.Name, "Numéro client"):
+			f.ClientNumber = cf.Value
+
+		case strings.Contains(cf.Name, "Entreprise"):
+			f.Company = cf.Value
+
+		case cf.Name == "Type de client:":
+			f.ClientType = cf.Value
+		}
+	}
+	return f
+}
+
+// SanitizeFields sanitizes a transaction received through the webhook, see
+// Sanitize.
+func (tr *Transaction) SanitizeFields(known func(Product) bool) error {
+	return tr.Sanitize(tr.CustomFields(), known)
+}
+
+// Sanitize normalizes the contact details and applies the order details f to
+// the transaction. Every product of the invoice must be known to the catalog
+// and ordered at least once, and as many plates are kept as the largest
+// product quantity, see plates.Parse. Every problem found is reported, joined
+// in a permanent error.
+func (tr *Transaction) Sanitize(f Fields, known func(Product) bool) error {
 	tr.Contact.FirstName = strings.TrimSpace(tr.Contact.FirstName)
 	tr.Contact.LastName = strings.TrimSpace(tr.Contact.LastName)
 	tr.Contact.StreetAndNo = strings.TrimSpace(tr.Contact.StreetAndNo)
@@ -83,57 +165,58 @@ func (tr *Transaction) SanitizeFields() error {
 	tr.Contact.Email = strings.TrimSpace(tr.Contact.Email)
 	tr.Contact.Company = strings.TrimSpace(tr.Contact.Company)
 
-  if len(tr.Invoice.Products) != 1 || tr.Invoice.Products[0].Name != "Badge Ajoverts" {
-    return fmt.Errorf("invalid product name or number of products")
-  }
-	platesQty := tr.Invoice.Products[0].Quantity
-	var platesStr string
-	for _, f := range tr.Invoice.CustomFields {
-		switch {
-		case strings.Contains(f.Name, "Numéros de plaques"):
-			platesStr = strings.ToUpper(strings.TrimSpace(f.Value))
-
-		case strings.Contains(f.Name, "Entreprise"):
-			tr.Contact.Company = strings.TrimSpace(f.Value)
-
-		case f.Name == "Type de client:":
-			switch f.Value {
-			case "entreprise":
-				tr.Contact.ClientType = Company
-			case "particulier":
-				tr.Contact.ClientType = Individual
-			default:
-				slog.Error("unknown client type", "field_value", f.Value)
-			}
+	problems := []error{}
+	if len(tr.Invoice.Products) == 0 {
+		problems = append(problems, errors.New("invoice without product"))
+	}
+	platesQty := 0
+	for _, p := range tr.Invoice.Products {
+		if !known(p) {
+			problems = append(problems, fmt.Errorf("unknown product %q (sku %q)", p.Name, p.SKU))
 		}
+		if p.Quantity < 1 {
+			problems = append(problems, fmt.Errorf("invalid quantity %d for product %q", p.Quantity, p.Name))
+		}
+		platesQty = max(platesQty, p.Quantity)
 	}
 
-	reg, _ := regexp.Compile(`([^\w,])`) // only allow \w and commas
-	platesStr = reg.ReplaceAllString(platesStr, "")
+	tr.ClientNumber = strings.TrimSpace(f.ClientNumber)
+	if company := strings.TrimSpace(f.Company); company != "" {
+		tr.Contact.Company = company
+	}
 
-	plates := strings.Split(platesStr, ",")
-	for i := range platesQty {
-		if i < len(plates) {
-			tr.Plates = append(tr.Plates, plates[i])
-		} else {
-			tr.Plates = append(tr.Plates, "N/D")
+	switch clientType := strings.TrimSpace(f.ClientType); clientType {
+	case "entreprise":
+		tr.Contact.ClientType = Company
+		if tr.Contact.Company == "" {
+			problems = append(problems, errors.New("company client without company name"))
 		}
+	case "particulier":
+		tr.Contact.ClientType = Individual
+	case "":
+		tr.Contact.ClientType = Individual
+		if tr.Contact.Company != "" {
+			tr.Contact.ClientType = Company
+		}
+	default:
+		problems = append(problems, fmt.Errorf("unknown client type %q", clientType))
 	}
 
-	if len(plates) > platesQty {
-		lastPlates := tr.Plates[platesQty-1:]
-		extraPlates := plates[platesQty:]
-		extraPlates = slices.DeleteFunc(extraPlates, func(s string) bool {
-			return s == ""
-		})
-		lastPlates = append(lastPlates, extraPlates...)
-		lastPlate := strings.Join(lastPlates, ".")
-		if len(lastPlate) > 30 {
-			lastPlate = lastPlate[:27] + "..."
-			slog.Info("plate", "len", len(lastPlate), "lastPlate", lastPlate)
+	tr.Plates, tr.PlateWarnings = nil, nil
+	if platesQty > 0 {
+		parsed := plates.Parse(f.Plates, platesQty)
+		tr.Plates = parsed.Plates
+		tr.PlateWarnings = parsed.Warnings
+		if !slices.ContainsFunc(parsed.Plates, func(p string) bool { return p != plates.Placeholder }) {
+			problems = append(problems, errors.New("no plate given"))
+		}
+		// unrecognized plates are kept, unless they cannot be recorded
+		for _, p := range parsed.Plates {
+			if len(p) > plates.MaxLength {
+				problems = append(problems, fmt.Errorf("plate %s is longer than %d characters", p, plates.MaxLength))
+			}
 		}
-		tr.Plates[platesQty-1] = lastPlate
 	}
 
-  return nil
+	return failure.NewPermanent(errors.Join(problems...))
 }
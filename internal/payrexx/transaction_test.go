@@ -5,9 +5,14 @@ import (
 	"testing"
 
 	"github.com/clementnuss/truckflow-user-importer/internal/payrexx"
+	"github.com/clementnuss/truckflow-user-importer/internal/plates"
 	"github.com/stretchr/testify/assert"
 )
 
+func isBadge(p payrexx.Product) bool {
+	return p.Name == "Badge Ajoverts" || p.SKU == "wood"
+}
+
 func TestCorrectWebhookParsing(t *testing.T) {
 	sampleTransaction := `
 {
@@ -63,12 +68,13 @@ func TestCorrectWebhookParsing(t *testing.T) {
 	err := json.Unmarshal([]byte(sampleTransaction), &formData)
 
   tr := formData.Transaction 
-  tr.SanitizeFields()
+  tr.SanitizeFields(isBadge)
 
   assert.Equal(t, []string{"JU12345", "JU54321"}, tr.Plates)
 
 	assert.NoError(t, err)
 	assert.Equal(t, "some@email.ch", tr.Contact.Email)
+	assert.Equal(t, "00014", tr.ClientNumber)
 	assert.Equal(t, 2, tr.Invoice.Products[0].Quantity)
 }
 
@@ -114,14 +120,18 @@ func TestMultiPlate(t *testing.T) {
 	err := json.Unmarshal([]byte(sampleTransaction), &formData)
 
   tr := formData.Transaction 
-  tr.SanitizeFields()
+  tr.SanitizeFields(isBadge)
 
-  assert.Equal(t, []string{"JU12345", "JU2.JU3.JU4"}, tr.Plates)
+  assert.Equal(t, []string{"JU12345", "JU2"}, tr.Plates)
+	if assert.Len(t, tr.PlateWarnings, 1) {
+		assert.Equal(t, plates.TooManyPlates, tr.PlateWarnings[0].Kind)
+		assert.Equal(t, "JU3,JU4", tr.PlateWarnings[0].Plate)
+	}
 
 	assert.NoError(t, err)
 }
 
-func TestLongLastPlate(t *testing.T) {
+func TestDuplicatePlates(t *testing.T) {
 	sampleTransaction := `
 {
   "transaction": {
@@ -163,9 +173,109 @@ func TestLongLastPlate(t *testing.T) {
 	err := json.Unmarshal([]byte(sampleTransaction), &formData)
 
   tr := formData.Transaction 
-  tr.SanitizeFields()
+  tr.SanitizeFields(isBadge)
+
+  assert.Equal(t, []string{"JU12345"}, tr.Plates)
+	assert.Len(t, tr.PlateWarnings, 3)
+
+	assert.NoError(t, err)
+}
+
+func TestSeveralProducts(t *testing.T) {
+	sampleTransaction := `
+{
+  "transaction": {
+    "uuid": "b63112e9",
+    "time": "2025-01-27 22:08:58",
+    "status": "confirmed",
+    "invoice": {
+      "products": [
+        {
+          "name": "Badge Ajoverts",
+          "price": 2000,
+          "quantity": 1,
+          "sku": null
+        },
+        {
+          "name": "Badge bois",
+          "price": 2000,
+          "quantity": 2,
+          "sku": "wood"
+        }
+      ],
+      "custom_fields": [
+        {
+          "type": "text",
+          "name": "Numéros de plaques (séparés par des virgules)",
+          "value": "JU12345, JU54321"
+        }
+      ]
+    }
+  }
+}
+`
+
+	formData := struct {
+		Transaction payrexx.Transaction `json:"transaction"`
+	}{}
+	assert.NoError(t, json.Unmarshal([]byte(sampleTransaction), &formData))
+
+	tr := formData.Transaction
+	assert.NoError(t, tr.SanitizeFields(isBadge))
+	assert.Equal(t, []string{"JU12345", "JU54321"}, tr.Plates)
+
+	tr = formData.Transaction
+	tr.Invoice.Products = append(tr.Invoice.Products, payrexx.Product{Name: "Donation", Quantity: 1})
+	assert.Error(t, tr.SanitizeFields(isBadge))
+}
+
+func TestInvalidQuantity(t *testing.T) {
+	sampleTransaction := `
+{
+  "transaction": {
+    "uuid": "b63112e9",
+    "time": "2025-01-27 22:08:58",
+    "status": "confirmed",
+    "invoice": {
+      "products": [
+        {"name": "Badge Ajoverts", "price": 2000, "quantity": -1},
+        {"name": "Badge bois", "price": 2000, "quantity": 1, "sku": "wood"}
+      ],
+      "custom_fields": [
+        {
+          "type": "text",
+          "name": "Numéros de plaques (séparés par des virgules)",
+          "value": "JU12345"
+        }
+      ]
+    }
+  }
+}
+`
+
+	formData := struct {
+		Transaction payrexx.Transaction `json:"transaction"`
+	}{}
+	assert.NoError(t, json.Unmarshal([]byte(sampleTransaction), &formData))
+
+	tr := formData.Transaction
+	err := tr.SanitizeFields(isBadge)
+	assert.ErrorContains(t, err, `invalid quantity -1 for product "Badge Ajoverts"`)
+	assert.NotContains(t, err.Error(), "Badge bois")
+}
 
-  assert.Equal(t, []string{"JU12345.JU12345.JU12345.JU1..."}, tr.Plates)
+func TestTooLongPlate(t *testing.T) {
+	tr := payrexx.Transaction{
+		Status:  payrexx.StatusConfirmed,
+		Invoice: payrexx.Invoice{Products: []payrexx.Product{{Name: "Badge Ajoverts", Quantity: 2}}},
+		Contact: payrexx.Contact{FirstName: "Foo", LastName: "Bar", Email: "some@email.ch"},
+	}
+	err := tr.Sanitize(payrexx.Fields{Plates: "JU12345, my plate is JU 54321 thanks"}, isBadge)
+	assert.ErrorContains(t, err, "plate MYPLATEISJU54321THANKS is longer than 15 characters")
 
+	// unrecognized plates are only warned about
+	err = tr.Sanitize(payrexx.Fields{Plates: "JU12345, HELLO"}, isBadge)
 	assert.NoError(t, err)
+	assert.Equal(t, []string{"JU12345", "HELLO"}, tr.Plates)
+	assert.Equal(t, plates.InvalidPlate, tr.PlateWarnings[0].Kind)
 }
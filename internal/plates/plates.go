@@ -0,0 +1,132 @@
+package plates
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Placeholder stands for a plate the customer did not provide.
+const Placeholder = "N/D"
+
+// MaxLength is the longest plate accepted.
+const MaxLength = 15
+
+type WarningKind string
+
+const (
+	InvalidPlate   WarningKind = "invalid_plate"
+	DuplicatePlate WarningKind = "duplicate_plate"
+	TooManyPlates  WarningKind = "too_many_plates"
+	TooFewPlates   WarningKind = "too_few_plates"
+)
+
+// Warning is an anomaly found while parsing plates.
+type Warning struct {
+	Kind    WarningKind `json:"kind"`
+	Plate   string      `json:"plate,omitempty"`
+	Message string      `json:"message"`
+}
+
+func (w Warning) String() string {
+	return w.Message
+}
+
+// Result holds the parsed plates and the anomalies found on the way.
+type Result struct {
+	Plates   []string
+	Warnings []Warning
+}
+
+var (
+	separators = regexp.MustCompile(`[,;/\n\r]+`)
+	noise      = regexp.MustCompile(`[^A-Z0-9]`)
+)
+
+// formats are tried in order, the first match wins.
+var formats = []struct {
+	name string
+	re   *regexp.Regexp
+}{
+	{"CH", regexp.MustCompile(`^(AG|AI|AR|BE|BL|BS|FR|GE|GL|GR|JU|LU|NE|NW|OW|SG|SH|SO|SZ|TG|TI|UR|VD|VS|ZG|ZH)[0-9]{1,6}$`)},
+	{"FL", regexp.MustCompile(`^FL[0-9]{1,5}$`)},
+	// France since 2009, Italy since 1994
+	{"FR/IT", regexp.MustCompile(`^[A-Z]{2}[0-9]{3}[A-Z]{2}$`)},
+	// older French plates: number, letters, département
+	{"FR", regexp.MustCompile(`^[0-9]{1,4}[A-Z]{1,3}(0[1-9]|[1-8][0-9]|9[0-5]|2A|2B|97[1-6])$`)},
+	{"DE", regexp.MustCompile(`^[A-Z]{1,3}[A-Z]{1,2}[0-9]{1,4}[EH]?$`)},
+	{"AT", regexp.MustCompile(`^[A-Z]{1,2}[0-9]{1,5}[A-Z]{1,3}$`)},
+}
+
+// Normalize uppercases the plate and strips everything but letters and
+// digits, so that "vd 123-456" becomes "VD123456".
+func Normalize(plate string) string {
+	return noise.ReplaceAllString(strings.ToUpper(plate), "")
+}
+
+// Recognize returns the registration format of a normalized plate, or false
+// when it matches none of the known Swiss and foreign formats.
+func Recognize(plate string) (string, bool) {
+	for _, f := range formats {
+		if f.re.MatchString(plate) {
+			return f.name, true
+		}
+	}
+	return "", false
+}
+
+// Parse splits raw on commas, semicolons, slashes and newlines, normalizes and
+// deduplicates the plates, and returns exactly expected of them. Missing
+// plates are filled with Placeholder and surplus ones are dropped, both with a
+// warning.
+func Parse(raw string, expected int) Result {
+	res := Result{}
+	seen := map[string]bool{}
+	for _, token := range separators.Split(raw, -1) {
+		plate := Normalize(token)
+		if plate == "" {
+			continue
+		}
+
+		if seen[plate] {
+			res.Warnings = append(res.Warnings, Warning{
+				Kind:    DuplicatePlate,
+				Plate:   plate,
+				Message: fmt.Sprintf("plate %s is given more than once", plate),
+			})
+			continue
+		}
+		seen[plate] = true
+
+		if _, ok := Recognize(plate); !ok || len(plate) > MaxLength {
+			res.Warnings = append(res.Warnings, Warning{
+				Kind:    InvalidPlate,
+				Plate:   plate,
+				Message: fmt.Sprintf("%q does not look like a plate number", strings.TrimSpace(token)),
+			})
+		}
+		res.Plates = append(res.Plates, plate)
+	}
+
+	if len(res.Plates) > expected {
+		extra := res.Plates[expected:]
+		res.Warnings = append(res.Warnings, Warning{
+			Kind:    TooManyPlates,
+			Plate:   strings.Join(extra, ","),
+			Message: fmt.Sprintf("%d plates given for %d badges, ignoring %s", len(res.Plates), expected, strings.Join(extra, ", ")),
+		})
+		res.Plates = res.Plates[:expected]
+	}
+
+	if len(res.Plates) < expected {
+		res.Warnings = append(res.Warnings, Warning{
+			Kind:    TooFewPlates,
+			Message: fmt.Sprintf("%d plates given for %d badges", len(res.Plates), expected),
+		})
+		for len(res.Plates) < expected {
+			res.Plates = append(res.Plates, Placeholder)
+		}
+	}
+
+	return res
+}
@@ -0,0 +1,104 @@
+package plates_test
+
+import (
+	"testing"
+
+	"github.com/clementnuss/truckflow-user-importer/internal/plates"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRecognize(t *testing.T) {
+	for plate, format := range map[string]string{
+		"VD123456": "CH",
+		"GE7890":   "CH",
+		"JU1":      "CH",
+		"FL12345":  "FL",
+		"AB123CD":  "FR/IT",
+		"1234AB25": "FR",
+		"BS1234":   "CH",
+		"MAB1234":  "DE",
+		"LRE1234H": "DE",
+		"W12345A":  "AT",
+	} {
+		got, ok := plates.Recognize(plate)
+		assert.True(t, ok, plate)
+		assert.Equal(t, format, got, plate)
+	}
+
+	for _, plate := range []string{"", "VD", "123456", "123AB", "VD1234567", "HELLO"} {
+		_, ok := plates.Recognize(plate)
+		assert.False(t, ok, plate)
+	}
+}
+
+func TestParse(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		raw      string
+		expected int
+		plates   []string
+		warnings []plates.WarningKind
+	}{
+		{
+			name:     "separators",
+			raw:      "VD 123 456; GE 7890/ju-12\nzh.1",
+			expected: 4,
+			plates:   []string{"VD123456", "GE7890", "JU12", "ZH1"},
+		},
+		{
+			name:     "trailing and empty separators",
+			raw:      "JU12345, Ju2,  ju3,; ju4!,",
+			expected: 4,
+			plates:   []string{"JU12345", "JU2", "JU3", "JU4"},
+		},
+		{
+			name:     "too many",
+			raw:      "JU12345, Ju2,  ju3,; ju4!,",
+			expected: 2,
+			plates:   []string{"JU12345", "JU2"},
+			warnings: []plates.WarningKind{plates.TooManyPlates},
+		},
+		{
+			name:     "too few",
+			raw:      "VD1",
+			expected: 3,
+			plates:   []string{"VD1", plates.Placeholder, plates.Placeholder},
+			warnings: []plates.WarningKind{plates.TooFewPlates},
+		},
+		{
+			name:     "empty",
+			raw:      " ",
+			expected: 1,
+			plates:   []string{plates.Placeholder},
+			warnings: []plates.WarningKind{plates.TooFewPlates},
+		},
+		{
+			name:     "duplicates",
+			raw:      "JU12345,ju 12345,JU12345",
+			expected: 1,
+			plates:   []string{"JU12345"},
+			warnings: []plates.WarningKind{plates.DuplicatePlate, plates.DuplicatePlate},
+		},
+		{
+			name:     "invalid",
+			raw:      "ma voiture, VD1",
+			expected: 2,
+			plates:   []string{"MAVOITURE", "VD1"},
+			warnings: []plates.WarningKind{plates.InvalidPlate},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			res := plates.Parse(tc.raw, tc.expected)
+			assert.Equal(t, tc.plates, res.Plates)
+
+			kinds := []plates.WarningKind{}
+			for _, w := range res.Warnings {
+				kinds = append(kinds, w.Kind)
+			}
+			if tc.warnings == nil {
+				tc.warnings = []plates.WarningKind{}
+			}
+			assert.Equal(t, tc.warnings, kinds)
+		})
+	}
+}
@@ -0,0 +1,54 @@
+package retry
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+// Policy tells how long to wait for a dependency.
+type Policy struct {
+	// Timeout bounds the total wait. Zero means a single attempt.
+	Timeout time.Duration
+	// MinDelay and MaxDelay bound the delay between two attempts, which
+	// doubles after each attempt.
+	MinDelay time.Duration
+	MaxDelay time.Duration
+}
+
+func DefaultPolicy() Policy {
+	return Policy{
+		Timeout:  5 * time.Minute,
+		MinDelay: time.Second,
+		MaxDelay: 30 * time.Second,
+	}
+}
+
+// Do calls fn until it succeeds, the timeout of the policy is reached or ctx
+// is cancelled, and logs what is being waited on.
+func Do(ctx context.Context, p Policy, what string, fn func(ctx context.Context) error) error {
+	start := time.Now()
+	delay := p.MinDelay
+	for attempt := 1; ; attempt++ {
+		err := fn(ctx)
+		if err == nil {
+			if attempt > 1 {
+				slog.Info("dependency available", "dependency", what, "attempts", attempt, "waited", time.Since(start).Round(time.Millisecond))
+			}
+			return nil
+		}
+
+		if time.Since(start)+delay > p.Timeout {
+			return fmt.Errorf("%s still unavailable after %d attempts: %w", what, attempt, err)
+		}
+		slog.Warn("waiting for dependency", "dependency", what, "attempt", attempt, "retry_in", delay, "error", err)
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("stopped waiting for %s: %w", what, err)
+		case <-time.After(delay):
+		}
+		delay = min(2*delay, p.MaxDelay)
+	}
+}
@@ -0,0 +1,45 @@
+package retry_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/clementnuss/truckflow-user-importer/internal/retry"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDo(t *testing.T) {
+	p := retry.Policy{Timeout: time.Second, MinDelay: time.Millisecond, MaxDelay: 4 * time.Millisecond}
+	down := errors.New("connection refused")
+
+	attempts := 0
+	err := retry.Do(context.Background(), p, "database", func(context.Context) error {
+		attempts += 1
+		if attempts < 4 {
+			return down
+		}
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 4, attempts)
+
+	p.Timeout = 20 * time.Millisecond
+	err = retry.Do(context.Background(), p, "database", func(context.Context) error { return down })
+	assert.ErrorIs(t, err, down)
+
+	attempts = 0
+	err = retry.Do(context.Background(), retry.Policy{}, "database", func(context.Context) error {
+		attempts += 1
+		return down
+	})
+	assert.ErrorIs(t, err, down)
+	assert.Equal(t, 1, attempts)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	p.Timeout = time.Hour
+	err = retry.Do(ctx, p, "database", func(context.Context) error { return down })
+	assert.ErrorIs(t, err, down)
+}
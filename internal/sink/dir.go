@@ -0,0 +1,137 @@
+package sink
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/clementnuss/truckflow-user-importer/internal/failure"
+)
+
+// Dir writes the import files to a local directory, e.g. a share mounted on
+// the host of the importer. Files are written to a temporary file first and
+// renamed, so that Truckflow never reads a partial import.
+type Dir struct {
+	Root string
+}
+
+func NewDir(root string) *Dir {
+	return &Dir{Root: root}
+}
+
+func (d *Dir) Put(ctx context.Context, name string, data []byte) error {
+	target, err := d.path(name)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(target), 0o755); err != nil {
+		return fileError(err)
+	}
+
+	tmp := filepath.Join(filepath.Dir(target), "."+filepath.Base(target)+".tmp")
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		os.Remove(tmp)
+		return fileError(err)
+	}
+	if err := os.Rename(tmp, target); err != nil {
+		os.Remove(tmp)
+		return fileError(err)
+	}
+	return nil
+}
+
+func (d *Dir) Remove(ctx context.Context, name string) error {
+	target, err := d.path(name)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(target); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fileError(err)
+	}
+	return nil
+}
+
+func (d *Dir) List(ctx context.Context, prefix string) ([]string, error) {
+	dir, err := listDir(prefix)
+	if err != nil {
+		return nil, err
+	}
+	paths := []string{}
+	err = filepath.WalkDir(filepath.Join(d.Root, filepath.FromSlash(dir)), func(name string, e fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if e.IsDir() || strings.HasPrefix(e.Name(), ".") {
+			return nil
+		}
+		rel, err := filepath.Rel(d.Root, name)
+		if err != nil {
+			return err
+		}
+		if rel = filepath.ToSlash(rel); strings.HasPrefix(rel, prefix) {
+			paths = append(paths, rel)
+		}
+		return nil
+	})
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, fileError(err)
+	}
+	return paths, nil
+}
+
+func (d *Dir) Check(ctx context.Context) error {
+	info, err := os.Stat(d.Root)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("%s is not a directory", d.Root)
+	}
+	return nil
+}
+
+func (d *Dir) String() string {
+	return "file://" + filepath.ToSlash(d.Root)
+}
+
+// path resolves name within the root directory.
+func (d *Dir) path(name string) (string, error) {
+	if !localPath(name) {
+		return "", failure.NewPermanent(fmt.Errorf("invalid path %q", name))
+	}
+	return filepath.Join(d.Root, filepath.FromSlash(name)), nil
+}
+
+// localPath reports whether the slash separated name stays within the
+// directory it is relative to.
+func localPath(name string) bool {
+	return name != "" && !path.IsAbs(name) && filepath.IsLocal(filepath.FromSlash(name))
+}
+
+// listDir is the directory holding the files starting with prefix.
+func listDir(prefix string) (string, error) {
+	dir := prefix
+	if !strings.HasSuffix(dir, "/") {
+		dir = path.Dir(dir)
+	}
+	dir = path.Clean(dir)
+	if dir != "." && !localPath(dir) {
+		return "", failure.NewPermanent(fmt.Errorf("invalid prefix %q", prefix))
+	}
+	return dir, nil
+}
+
+// fileError classifies a file system error: a permission issue needs the
+// configuration to be fixed, anything else, e.g. a full disk or an
+// unavailable share, is transient.
+func fileError(err error) error {
+	if errors.Is(err, fs.ErrPermission) {
+		return failure.NewPermanent(err)
+	}
+	return failure.NewTransient(err)
+}
@@ -0,0 +1,86 @@
+package sink
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/clementnuss/truckflow-user-importer/internal/failure"
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+// S3 writes the import files to a bucket.
+type S3 struct {
+	Client *minio.Client
+	Bucket string
+}
+
+// OpenS3 connects to the bucket S3_BUCKET of the S3_ENDPOINT server, with the
+// credentials S3_ACCESS_KEY_ID and S3_SECRET_ACCESS_KEY.
+func OpenS3() (*S3, error) {
+	client, err := minio.New(os.Getenv("S3_ENDPOINT"), &minio.Options{
+		Creds:  credentials.NewStaticV4(os.Getenv("S3_ACCESS_KEY_ID"), os.Getenv("S3_SECRET_ACCESS_KEY"), ""),
+		Secure: true,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("minio initialization error: %v", err)
+	}
+	return &S3{Client: client, Bucket: os.Getenv("S3_BUCKET")}, nil
+}
+
+func (s *S3) Put(ctx context.Context, path string, data []byte) error {
+	_, err := s.Client.PutObject(ctx, s.Bucket, path, bytes.NewReader(data), int64(len(data)), minio.PutObjectOptions{})
+	if err != nil {
+		return &failure.Error{Kind: s3ErrorKind(err), Err: err}
+	}
+	return nil
+}
+
+func (s *S3) Remove(ctx context.Context, path string) error {
+	err := s.Client.RemoveObject(ctx, s.Bucket, path, minio.RemoveObjectOptions{})
+	if err != nil {
+		return &failure.Error{Kind: s3ErrorKind(err), Err: err}
+	}
+	return nil
+}
+
+func (s *S3) List(ctx context.Context, prefix string) ([]string, error) {
+	paths := []string{}
+	for obj := range s.Client.ListObjects(ctx, s.Bucket, minio.ListObjectsOptions{Prefix: prefix, Recursive: true}) {
+		if obj.Err != nil {
+			return nil, &failure.Error{Kind: s3ErrorKind(obj.Err), Err: obj.Err}
+		}
+		paths = append(paths, obj.Key)
+	}
+	return paths, nil
+}
+
+// Check makes sure the bucket exists, which is about the cheapest
+// authenticated S3 request.
+func (s *S3) Check(ctx context.Context) error {
+	exists, err := s.Client.BucketExists(ctx, s.Bucket)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return fmt.Errorf("bucket %s does not exist", s.Bucket)
+	}
+	return nil
+}
+
+func (s *S3) String() string {
+	return "s3://" + s.Bucket
+}
+
+// s3ErrorKind tells whether an S3 error is worth retrying. Errors that need
+// the configuration to be fixed are permanent, anything else, e.g. an outage,
+// is transient.
+func s3ErrorKind(err error) failure.Kind {
+	switch minio.ToErrorResponse(err).Code {
+	case "AccessDenied", "InvalidAccessKeyId", "SignatureDoesNotMatch", "NoSuchBucket", "InvalidBucketName":
+		return failure.Permanent
+	}
+	return failure.Transient
+}
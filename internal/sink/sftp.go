@@ -0,0 +1,268 @@
+package sink
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/clementnuss/truckflow-user-importer/internal/failure"
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// SFTP writes the import files to a directory of an SFTP server. Like Dir, it
+// writes a temporary file first and renames it once complete.
+//
+// The connection is opened on first use, and opened again after a failure.
+type SFTP struct {
+	Address string
+	Config  *ssh.ClientConfig
+	// Root is the directory of the server the paths are relative to.
+	Root string
+
+	mu     sync.Mutex
+	conn   *ssh.Client
+	client *sftp.Client
+}
+
+func NewSFTP(address string, config *ssh.ClientConfig, root string) *SFTP {
+	if root == "" {
+		root = "."
+	}
+	return &SFTP{Address: address, Config: config, Root: root}
+}
+
+// OpenSFTP configures the SFTP sink from the environment: the server is
+// SFTP_ADDRESS, whose host key must be listed in the SFTP_KNOWN_HOSTS file.
+// SFTP_USER logs in with SFTP_PASSWORD or with the key in
+// SFTP_PRIVATE_KEY_FILE, and the files are written to SFTP_DIR.
+func OpenSFTP() (*SFTP, error) {
+	address := os.Getenv("SFTP_ADDRESS")
+	if address == "" {
+		return nil, errors.New("SFTP_ADDRESS is required with IMPORT_SINK=sftp")
+	}
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		address = net.JoinHostPort(address, "22")
+	}
+
+	knownHosts := os.Getenv("SFTP_KNOWN_HOSTS")
+	if knownHosts == "" {
+		return nil, errors.New("SFTP_KNOWN_HOSTS is required with IMPORT_SINK=sftp")
+	}
+	hostKeyCallback, err := knownhosts.New(knownHosts)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read SFTP_KNOWN_HOSTS: %v", err)
+	}
+
+	var auth []ssh.AuthMethod
+	if keyFile := os.Getenv("SFTP_PRIVATE_KEY_FILE"); keyFile != "" {
+		key, err := os.ReadFile(keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read SFTP_PRIVATE_KEY_FILE: %v", err)
+		}
+		signer, err := ssh.ParsePrivateKey(key)
+		if err != nil {
+			return nil, fmt.Errorf("invalid SFTP_PRIVATE_KEY_FILE: %v", err)
+		}
+		auth = append(auth, ssh.PublicKeys(signer))
+	}
+	if password := os.Getenv("SFTP_PASSWORD"); password != "" {
+		auth = append(auth, ssh.Password(password))
+	}
+	if len(auth) == 0 {
+		return nil, errors.New("either SFTP_PASSWORD or SFTP_PRIVATE_KEY_FILE is required with IMPORT_SINK=sftp")
+	}
+
+	return NewSFTP(address, &ssh.ClientConfig{
+		User:            os.Getenv("SFTP_USER"),
+		Auth:            auth,
+		HostKeyCallback: hostKeyCallback,
+		Timeout:         10 * time.Second,
+	}, os.Getenv("SFTP_DIR")), nil
+}
+
+func (s *SFTP) Put(ctx context.Context, name string, data []byte) error {
+	if !localPath(name) {
+		return failure.NewPermanent(fmt.Errorf("invalid path %q", name))
+	}
+	client, err := s.connect(ctx)
+	if err != nil {
+		return err
+	}
+
+	target := path.Join(s.Root, name)
+	tmp := path.Join(path.Dir(target), "."+path.Base(target)+".tmp")
+	err = client.MkdirAll(path.Dir(target))
+	if err == nil {
+		err = s.write(client, tmp, data)
+	}
+	if err == nil {
+		err = s.rename(client, tmp, target)
+	}
+	if err != nil {
+		client.Remove(tmp)
+		return s.fail(client, err)
+	}
+	return nil
+}
+
+func (s *SFTP) write(client *sftp.Client, name string, data []byte) error {
+	f, err := client.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// rename replaces newname atomically when the server supports it.
+func (s *SFTP) rename(client *sftp.Client, oldname, newname string) error {
+	if _, ok := client.HasExtension("posix-rename@openssh.com"); ok {
+		return client.PosixRename(oldname, newname)
+	}
+	// plain SFTP renames fail when the target exists
+	if err := client.Remove(newname); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return client.Rename(oldname, newname)
+}
+
+func (s *SFTP) Remove(ctx context.Context, name string) error {
+	if !localPath(name) {
+		return failure.NewPermanent(fmt.Errorf("invalid path %q", name))
+	}
+	client, err := s.connect(ctx)
+	if err != nil {
+		return err
+	}
+	if err := client.Remove(path.Join(s.Root, name)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return s.fail(client, err)
+	}
+	return nil
+}
+
+func (s *SFTP) List(ctx context.Context, prefix string) ([]string, error) {
+	dir, err := listDir(prefix)
+	if err != nil {
+		return nil, err
+	}
+	client, err := s.connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	paths := []string{}
+	root := path.Join(s.Root, dir)
+	for w := client.Walk(root); w.Step(); {
+		if err := w.Err(); err != nil {
+			if w.Path() == root && errors.Is(err, fs.ErrNotExist) {
+				break
+			}
+			return nil, s.fail(client, err)
+		}
+		if w.Stat().IsDir() || strings.HasPrefix(path.Base(w.Path()), ".") {
+			continue
+		}
+		name := path.Join(dir, strings.TrimPrefix(w.Path(), root+"/"))
+		if strings.HasPrefix(name, prefix) {
+			paths = append(paths, name)
+		}
+	}
+	slices.Sort(paths)
+	return paths, nil
+}
+
+func (s *SFTP) Check(ctx context.Context) error {
+	client, err := s.connect(ctx)
+	if err != nil {
+		return err
+	}
+	info, err := client.Stat(s.Root)
+	if err != nil {
+		return s.fail(client, err)
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("%s is not a directory", s.Root)
+	}
+	return nil
+}
+
+func (s *SFTP) String() string {
+	return "sftp://" + s.Address + path.Join("/", s.Root)
+}
+
+// Close closes the connection to the server, if any.
+func (s *SFTP) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.disconnect()
+}
+
+// connect returns the current client, connecting to the server if needed.
+func (s *SFTP) connect(ctx context.Context) (*sftp.Client, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.client != nil {
+		return s.client, nil
+	}
+
+	dialer := net.Dialer{Timeout: s.Config.Timeout}
+	nc, err := dialer.DialContext(ctx, "tcp", s.Address)
+	if err != nil {
+		return nil, failure.NewTransient(fmt.Errorf("unable to connect to %s: %w", s.Address, err))
+	}
+	c, chans, reqs, err := ssh.NewClientConn(nc, s.Address, s.Config)
+	if err != nil {
+		nc.Close()
+		// an unknown host key needs the configuration to be fixed
+		var keyErr *knownhosts.KeyError
+		if errors.As(err, &keyErr) {
+			return nil, failure.NewPermanent(fmt.Errorf("ssh handshake with %s failed: %w", s.Address, err))
+		}
+		return nil, failure.NewTransient(fmt.Errorf("ssh handshake with %s failed: %w", s.Address, err))
+	}
+	conn := ssh.NewClient(c, chans, reqs)
+	client, err := sftp.NewClient(conn)
+	if err != nil {
+		conn.Close()
+		return nil, failure.NewTransient(fmt.Errorf("unable to start sftp session: %w", err))
+	}
+	s.conn, s.client = conn, client
+	return client, nil
+}
+
+// fail classifies err, and drops the connection unless the server answered
+// with an error status, so that the next call reconnects.
+func (s *SFTP) fail(client *sftp.Client, err error) error {
+	var status *sftp.StatusError
+	if !errors.As(err, &status) && !errors.Is(err, fs.ErrPermission) && !errors.Is(err, fs.ErrNotExist) {
+		s.mu.Lock()
+		if s.client == client {
+			s.disconnect()
+		}
+		s.mu.Unlock()
+	}
+	return fileError(err)
+}
+
+func (s *SFTP) disconnect() error {
+	if s.client == nil {
+		return nil
+	}
+	s.client.Close()
+	err := s.conn.Close()
+	s.conn, s.client = nil, nil
+	return err
+}
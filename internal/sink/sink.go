@@ -0,0 +1,65 @@
+package sink
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+)
+
+// ImportSink is where the import files are written for Truckflow to pick them
+// up. Paths are slash separated, e.g. importer/tiers_import_00001.json.
+type ImportSink interface {
+	// Put writes data at path, replacing any existing file. Errors are
+	// classified with the failure package.
+	Put(ctx context.Context, path string, data []byte) error
+	Remove(ctx context.Context, path string) error
+	// List returns the paths of the files starting with prefix, e.g.
+	// importer/tiers_import_00001, in lexical order. Temporary files are
+	// left out.
+	List(ctx context.Context, prefix string) ([]string, error)
+	// Check is a cheap test that the sink is reachable, for health probes.
+	Check(ctx context.Context) error
+	// String describes the sink for logs, e.g. s3://bucket.
+	String() string
+}
+
+// Sinks selected with IMPORT_SINK.
+const (
+	KindS3   = "s3"
+	KindDir  = "dir"
+	KindSFTP = "sftp"
+)
+
+// Open opens the sink selected with IMPORT_SINK: the S3 bucket by default, see
+// OpenS3, the local directory IMPORT_DIR, see NewDir, or an SFTP server, see
+// OpenSFTP.
+func Open() (ImportSink, error) {
+	switch kind := os.Getenv("IMPORT_SINK"); kind {
+	case "", KindS3:
+		return OpenS3()
+	case KindDir:
+		dir := os.Getenv("IMPORT_DIR")
+		if dir == "" {
+			return nil, fmt.Errorf("IMPORT_DIR is required with IMPORT_SINK=%s", KindDir)
+		}
+		return NewDir(dir), nil
+	case KindSFTP:
+		return OpenSFTP()
+	default:
+		return nil, fmt.Errorf("unknown IMPORT_SINK %q, expected s3, dir or sftp", kind)
+	}
+}
+
+// Probe makes sure the sink accepts writes, by writing and removing a test
+// file.
+func Probe(ctx context.Context, s ImportSink) error {
+	testData := []byte(fmt.Sprintf("test string %v", time.Now()))
+	if err := s.Put(ctx, "importer/test", testData); err != nil {
+		return fmt.Errorf("unable to create test file on %s: %v", s, err)
+	}
+	if err := s.Remove(ctx, "importer/test"); err != nil {
+		return fmt.Errorf("unable to delete test file on %s: %v", s, err)
+	}
+	return nil
+}
@@ -0,0 +1,171 @@
+package sink
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/clementnuss/truckflow-user-importer/internal/failure"
+	"github.com/minio/minio-go/v7"
+	"github.com/pkg/sftp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// testSink runs the checks every sink must pass, root being the local
+// directory the files of s end up in.
+func testSink(t *testing.T, s ImportSink, root string) {
+	ctx := context.Background()
+	require.NoError(t, s.Check(ctx))
+
+	require.NoError(t, s.Put(ctx, "importer/tiers_import_00001.json", []byte("first")))
+	require.NoError(t, s.Put(ctx, "importer/tiers_import_00001.json", []byte("second")))
+	content, err := os.ReadFile(filepath.Join(root, "importer", "tiers_import_00001.json"))
+	require.NoError(t, err)
+	assert.Equal(t, "second", string(content))
+
+	// no temporary file is left behind
+	entries, err := os.ReadDir(filepath.Join(root, "importer"))
+	require.NoError(t, err)
+	assert.Len(t, entries, 1)
+
+	require.NoError(t, s.Put(ctx, "importer/pass_import_00001.json", []byte("pass")))
+	require.NoError(t, os.WriteFile(filepath.Join(root, "importer", ".pass_import_00002.json.tmp"), []byte("partial"), 0o644))
+	paths, err := s.List(ctx, "importer/")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"importer/pass_import_00001.json", "importer/tiers_import_00001.json"}, paths)
+	paths, err = s.List(ctx, "importer/tiers_import_00001")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"importer/tiers_import_00001.json"}, paths)
+	paths, err = s.List(ctx, "missing/tiers_import_")
+	require.NoError(t, err)
+	assert.Empty(t, paths)
+	_, err = s.List(ctx, "../")
+	assert.Equal(t, failure.Permanent, failure.KindOf(err))
+	require.NoError(t, s.Remove(ctx, "importer/pass_import_00001.json"))
+
+	require.NoError(t, Probe(ctx, s))
+
+	err = s.Put(ctx, "../escape.json", []byte("{}"))
+	assert.Equal(t, failure.Permanent, failure.KindOf(err))
+}
+
+func TestDir(t *testing.T) {
+	root := t.TempDir()
+	testSink(t, NewDir(root), root)
+
+	assert.Error(t, NewDir(filepath.Join(root, "missing")).Check(context.Background()))
+}
+
+// sftpServer serves root over SFTP to the user foo with the password bar, and
+// returns its address and host key.
+func sftpServer(t *testing.T, root string) (string, ssh.PublicKey) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	hostKey, err := ssh.NewSignerFromKey(key)
+	require.NoError(t, err)
+
+	config := &ssh.ServerConfig{
+		PasswordCallback: func(c ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			if c.User() == "foo" && string(password) == "bar" {
+				return nil, nil
+			}
+			return nil, assert.AnError
+		},
+	}
+	config.AddHostKey(hostKey)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		for {
+			nc, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go serveSFTP(nc, config, root)
+		}
+	}()
+	return l.Addr().String(), hostKey.PublicKey()
+}
+
+func serveSFTP(nc net.Conn, config *ssh.ServerConfig, root string) {
+	defer nc.Close()
+	_, chans, reqs, err := ssh.NewServerConn(nc, config)
+	if err != nil {
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+
+	for newChannel := range chans {
+		if newChannel.ChannelType() != "session" {
+			newChannel.Reject(ssh.UnknownChannelType, "unknown channel type")
+			continue
+		}
+		channel, requests, err := newChannel.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			for req := range requests {
+				req.Reply(req.Type == "subsystem" && string(req.Payload[4:]) == "sftp", nil)
+			}
+		}()
+
+		server, err := sftp.NewServer(channel, sftp.WithServerWorkingDirectory(root))
+		if err != nil {
+			channel.Close()
+			return
+		}
+		go func() {
+			server.Serve()
+			server.Close()
+		}()
+	}
+}
+
+func TestSFTP(t *testing.T) {
+	root := t.TempDir()
+	address, hostKey := sftpServer(t, root)
+
+	s := NewSFTP(address, &ssh.ClientConfig{
+		User:            "foo",
+		Auth:            []ssh.AuthMethod{ssh.Password("bar")},
+		HostKeyCallback: ssh.FixedHostKey(hostKey),
+	}, "")
+	t.Cleanup(func() { s.Close() })
+	testSink(t, s, root)
+
+	// the next call reconnects after the connection is lost
+	s.mu.Lock()
+	s.conn.Close()
+	s.mu.Unlock()
+	assert.Error(t, s.Check(context.Background()))
+	assert.NoError(t, s.Check(context.Background()))
+
+	// a host key that does not match the known hosts is a permanent error
+	other, _ := sftpServer(t, root)
+	knownHosts := filepath.Join(t.TempDir(), "known_hosts")
+	require.NoError(t, os.WriteFile(knownHosts, []byte(knownhosts.Line([]string{other}, hostKey)+"\n"), 0o600))
+	hostKeyCallback, err := knownhosts.New(knownHosts)
+	require.NoError(t, err)
+	err = NewSFTP(other, &ssh.ClientConfig{
+		User:            "foo",
+		Auth:            []ssh.AuthMethod{ssh.Password("bar")},
+		HostKeyCallback: hostKeyCallback,
+	}, "").Check(context.Background())
+	assert.Equal(t, failure.Permanent, failure.KindOf(err))
+}
+
+func TestS3ErrorKind(t *testing.T) {
+	assert.Equal(t, failure.Permanent, s3ErrorKind(minio.ErrorResponse{Code: "NoSuchBucket", StatusCode: 404}))
+	assert.Equal(t, failure.Transient, s3ErrorKind(minio.ErrorResponse{Code: "SlowDown", StatusCode: 503}))
+}
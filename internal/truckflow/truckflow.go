@@ -28,6 +28,7 @@ type Pass struct {
 	CompanyCode string `json:"CompanyCode"`
 	TiersCode   string `json:"TiersCode"`
 	ProductCode string `json:"ProductCode"`
+	Active      bool   `json:"IsActive"`
 }
 
 type PassImport struct {
@@ -36,10 +37,11 @@ type PassImport struct {
 	Items   []Pass `json:"Items"`
 }
 
-func NewPass() *Pass {
+func NewPass(flowType, productCode string) *Pass {
 	p := Pass{}
-	p.FlowType = "Réception"
-	p.ProductCode = "Dechets verts"
+	p.FlowType = flowType
+	p.ProductCode = productCode
+	p.Active = true
 
 	return &p
 }
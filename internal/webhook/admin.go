@@ -0,0 +1,203 @@
+package webhook
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/clementnuss/truckflow-user-importer/internal/clienthash"
+	"github.com/clementnuss/truckflow-user-importer/internal/database"
+	"github.com/clementnuss/truckflow-user-importer/internal/failure"
+)
+
+// RequireToken only lets requests carrying the bearer token through. Admin
+// endpoints are disabled altogether when no token is configured.
+func RequireToken(token string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		got, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if token == "" || !ok || subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// ReplayHandler replays stored webhook events. The selection is given with
+// the transaction, from, to and failed query parameters, see ReplayFilter, and
+// force=true bypasses the idempotency check.
+func ReplayHandler(w http.ResponseWriter, r *http.Request, im *Importer) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	q := r.URL.Query()
+	filter, err := ReplayFilter(q.Get("transaction"), q.Get("from"), q.Get("to"), q.Get("failed") == "true")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	results, err := im.Replay(r.Context(), filter, q.Get("force") == "true")
+	if err != nil {
+		slog.Error("replay error", "error", err)
+		http.Error(w, "Replay error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(results)
+}
+
+// CustomerPasses is a customer along with every pass issued to it.
+type CustomerPasses struct {
+	database.Customer
+	Passes []database.Pass `json:"passes"`
+}
+
+// CustomersHandler lists the customers matching the email or code query
+// parameter, with their passes. Only one of them may be given.
+func CustomersHandler(w http.ResponseWriter, r *http.Request, db database.Queries, hasher *clienthash.Hasher) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	email, code := r.URL.Query().Get("email"), r.URL.Query().Get("code")
+	if email == "" && code == "" {
+		http.Error(w, "email or code must be given", http.StatusBadRequest)
+		return
+	}
+	if email != "" && code != "" {
+		http.Error(w, "email and code cannot be given together", http.StatusBadRequest)
+		return
+	}
+
+	// customers not rewritten yet are still recorded with a previous hash
+	hashes := []string{""}
+	if email != "" {
+		hashes = hasher.Candidates(email)
+	}
+	customers := []database.Customer{}
+	for _, h := range hashes {
+		found, err := db.FindCustomers(h, code)
+		if err != nil {
+			slog.Error("unable to retrieve customers", "error", err)
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		customers = append(customers, found...)
+	}
+
+	res := []CustomerPasses{}
+	for _, c := range customers {
+		passes, err := db.TiersPasses(c.TiersCode)
+		if err != nil {
+			slog.Error("unable to retrieve passes", "code", c.TiersCode, "error", err)
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		res = append(res, CustomerPasses{Customer: c, Passes: passes})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(res)
+}
+
+// ReviewsHandler lists the transactions pending review.
+func ReviewsHandler(w http.ResponseWriter, r *http.Request, im *Importer) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	reviews, err := im.Reviews(r.Context())
+	if err != nil {
+		slog.Error("unable to list reviews", "error", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(reviews)
+}
+
+// ReviewHandler replaces the overrides of the review given by the id path
+// value with the JSON encoded Overrides of the body.
+func ReviewHandler(w http.ResponseWriter, r *http.Request, im *Importer) {
+	if r.Method != http.MethodPut {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid event id", http.StatusBadRequest)
+		return
+	}
+	overrides := Overrides{}
+	if err := json.NewDecoder(r.Body).Decode(&overrides); err != nil {
+		http.Error(w, "Error parsing JSON", http.StatusBadRequest)
+		return
+	}
+
+	review, err := im.EditReview(r.Context(), id, overrides)
+	if errors.Is(err, ErrNotInReview) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	} else if err != nil {
+		slog.Error("unable to edit review", "event", id, "error", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(review)
+}
+
+// ApproveHandler imports the review given by the id path value. Transactions
+// still invalid or rejected are answered with 422.
+func ApproveHandler(w http.ResponseWriter, r *http.Request, im *Importer) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid event id", http.StatusBadRequest)
+		return
+	}
+
+	out, err := im.ApproveReview(r.Context(), id)
+	var ve *ValidationError
+	switch {
+	case errors.Is(err, ErrNotInReview):
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	case errors.As(err, &ve):
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		_ = json.NewEncoder(w).Encode(ve)
+		return
+	case ErrorKind(err) == failure.Permanent:
+		http.Error(w, "Import error, the event was rejected", http.StatusUnprocessableEntity)
+		return
+	case ErrorKind(err) == failure.Transient:
+		w.Header().Set("Retry-After", "0")
+		http.Error(w, "Import error, the event will be retried", http.StatusServiceUnavailable)
+		return
+	case err != nil:
+		slog.Error("unable to approve review", "event", id, "error", err)
+		http.Error(w, "Unable to approve the review", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(out)
+}
@@ -0,0 +1,37 @@
+package webhook
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCustomersHandler(t *testing.T) {
+	pool, _ := testPool(t)
+	code, _ := deliver(t, pool, importPayload)
+	require.Equal(t, http.StatusOK, code)
+
+	customers := func(query string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/admin/customers?"+query, nil)
+		rec := httptest.NewRecorder()
+		CustomersHandler(rec, req, pool.Importer.DB, pool.Importer.Hasher)
+		return rec
+	}
+
+	for _, query := range []string{"email=some@email.ch", "code=00001"} {
+		rec := customers(query)
+		require.Equal(t, http.StatusOK, rec.Code, query)
+		res := []CustomerPasses{}
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &res))
+		require.Len(t, res, 1, query)
+		assert.Equal(t, "00001", res[0].TiersCode)
+		assert.Len(t, res[0].Passes, 1)
+	}
+
+	assert.Equal(t, http.StatusBadRequest, customers("").Code)
+	assert.Equal(t, http.StatusBadRequest, customers("email=some@email.ch&code=00002").Code)
+}
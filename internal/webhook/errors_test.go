@@ -0,0 +1,26 @@
+package webhook
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/clementnuss/truckflow-user-importer/internal/failure"
+	"github.com/go-sql-driver/mysql"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestErrorKind(t *testing.T) {
+	deadlock := &mysql.MySQLError{Number: 1213, Message: "Deadlock found"}
+	tooLong := &mysql.MySQLError{Number: 1406, Message: "Data too long"}
+
+	for err, kind := range map[error]failure.Kind{
+		newValidationError(errors.New("no plate given")):                                  failure.Permanent,
+		fmt.Errorf("unable to allocate pass codes: %w", deadlock):                         failure.Transient,
+		fmt.Errorf("unable to record pass: %w", tooLong):                                  failure.Permanent,
+		fmt.Errorf("pass.json: %w", failure.NewTransient(errors.New("connection reset"))): failure.Transient,
+		errors.New("something else"):                                                      failure.Unknown,
+	} {
+		assert.Equal(t, kind, ErrorKind(err), err.Error())
+	}
+}
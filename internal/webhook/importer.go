@@ -0,0 +1,323 @@
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/clementnuss/truckflow-user-importer/internal/clienthash"
+	"github.com/clementnuss/truckflow-user-importer/internal/config"
+	"github.com/clementnuss/truckflow-user-importer/internal/database"
+	"github.com/clementnuss/truckflow-user-importer/internal/failure"
+	"github.com/clementnuss/truckflow-user-importer/internal/metrics"
+	"github.com/clementnuss/truckflow-user-importer/internal/payrexx"
+	"github.com/clementnuss/truckflow-user-importer/internal/plates"
+	"github.com/clementnuss/truckflow-user-importer/internal/sink"
+	"github.com/clementnuss/truckflow-user-importer/internal/tracing"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// lockTimeout bounds the wait for another replica importing a transaction of
+// the same customer.
+const lockTimeout = 30 * time.Second
+
+// Payload is the body of a Payrexx webhook.
+type Payload struct {
+	Transaction payrexx.Transaction `json:"transaction"`
+	Payout      payrexx.Payout      `json:"payout"`
+}
+
+// Importer turns Payrexx transactions into Truckflow tiers and pass imports.
+type Importer struct {
+	DB     database.Store
+	Sink   sink.ImportSink
+	Hasher *clienthash.Hasher
+	Config *config.Config
+}
+
+// ImportOptions alter the behaviour of Import.
+type ImportOptions struct {
+	// Force imports the transaction even if it was already processed.
+	Force bool
+	// Overrides are the corrections made to the transaction during a
+	// review.
+	Overrides *Overrides
+}
+
+// Outcome tells what an import did.
+type Outcome struct {
+	// Ignored is the reason why the payload was not imported.
+	Ignored string `json:"ignored,omitempty"`
+	// AlreadyProcessed is set when the transaction was skipped.
+	AlreadyProcessed bool `json:"already_processed,omitempty"`
+	// Deactivated is set when the passes of a refunded or cancelled
+	// transaction were deactivated.
+	Deactivated bool `json:"deactivated,omitempty"`
+	// TiersCode and ParkCodes are the codes of the tiers and passes created
+	// or deactivated.
+	TiersCode string   `json:"tiers_code,omitempty"`
+	ParkCodes []string `json:"park_codes,omitempty"`
+	// Warnings are the anomalies found in the plates of the transaction.
+	Warnings []plates.Warning `json:"warnings,omitempty"`
+	// PendingUploads is set when the import files could not be uploaded
+	// yet. The Reconciler takes care of them.
+	PendingUploads bool `json:"pending_uploads,omitempty"`
+}
+
+// Import runs the tiers/pass pipeline for a raw webhook payload. Payloads that
+// do not need to be imported (payouts, unconfirmed transactions, ...) are
+// ignored without error.
+func (im *Importer) Import(ctx context.Context, body []byte, opts ImportOptions) (out *Outcome, err error) {
+	ctx, span := tracing.Start(ctx, "Import")
+	defer func() { tracing.End(span, err) }()
+
+	transaction, reason, err := im.parse(ctx, body, opts.Overrides)
+	if err != nil {
+		return nil, err
+	}
+	if transaction == nil {
+		slog.Info("ignoring webhook", "reason", reason)
+		return &Outcome{Ignored: reason}, nil
+	}
+
+	if payrexx.IsReversal(transaction.Status) {
+		return im.deactivate(ctx, *transaction)
+	}
+
+	return im.ImportTransaction(ctx, *transaction, opts)
+}
+
+// ImportTransaction imports a sanitized, confirmed transaction.
+func (im *Importer) ImportTransaction(ctx context.Context, transaction payrexx.Transaction, opts ImportOptions) (out *Outcome, err error) {
+	ctx, span := tracing.Start(ctx, "ImportTransaction", tracing.TransactionUUID.String(transaction.Uuid))
+	defer func() { tracing.End(span, err) }()
+
+	// counters, outbox entries and the processed record are committed
+	// together, so that codes are never burned nor handed out twice
+	tx, clientHash, err := im.lockCustomer(ctx, transaction.Contact.Email)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	_, processedSpan := tracing.Start(ctx, "IsTransactionProcessed")
+	processed, err := tx.IsTransactionProcessed(clientHash, transaction.Uuid)
+	tracing.End(processedSpan, err)
+	if err != nil {
+		return nil, fmt.Errorf("database error: %w", err)
+	}
+	if processed && !opts.Force {
+		slog.Info("skipping already processed transaction.", "transaction", transaction.Uuid)
+		metrics.DuplicatesSkipped.Inc()
+		return &Outcome{AlreadyProcessed: true}, nil
+	} else if processed {
+		slog.Warn("forcing import of already processed transaction.", "transaction", transaction.Uuid)
+	}
+
+	p, err := im.plan(tx, transaction, clientHash, func(counter string, n int) (int, error) {
+		_, span := tracing.Start(ctx, "AllocateCounter", attribute.String("counter", counter), attribute.Int("count", n))
+		first, err := tx.AllocateCounter(counter, n)
+		tracing.End(span, err)
+		return first, err
+	})
+	if err != nil {
+		return nil, err
+	}
+	span.SetAttributes(tracing.TiersCode.String(p.tiers.Code))
+
+	if err := tx.SaveCustomer(p.customer); err != nil {
+		return nil, fmt.Errorf("unable to record customer: %w", err)
+	}
+	for _, pa := range p.passes {
+		if err := tx.AddPass(pa); err != nil {
+			return nil, fmt.Errorf("unable to record pass: %w", err)
+		}
+	}
+	for _, f := range p.files {
+		if err := tx.AddOutboxEntry(transaction.Uuid, f.Path, f.Content); err != nil {
+			return nil, fmt.Errorf("unable to record %s in outbox: %w", f.Path, err)
+		}
+	}
+	var warnings []byte
+	if len(transaction.PlateWarnings) > 0 {
+		warnings, err = json.Marshal(transaction.PlateWarnings)
+		if err != nil {
+			return nil, fmt.Errorf("error marshaling warnings: %w", err)
+		}
+	}
+	if err := tx.RecordProcessedTransaction(clientHash, transaction.Uuid, p.tiers.Code, warnings); err != nil {
+		return nil, fmt.Errorf("unable to record processed transaction: %w", err)
+	}
+
+	_, commitSpan := tracing.Start(ctx, "Commit")
+	err = tx.Commit()
+	tracing.End(commitSpan, err)
+	if err != nil {
+		return nil, fmt.Errorf("unable to commit import: %w", err)
+	}
+	if p.newTiers {
+		metrics.TiersCreated.Inc()
+	}
+	metrics.PassesCreated.Add(float64(len(p.passes)))
+
+	// a failed upload is finished later on by the Reconciler
+	pendingUploads := false
+	if err := im.flush(ctx, transaction.Uuid, 0); err != nil {
+		slog.Warn("import files not uploaded yet", "transaction", transaction.Uuid, "kind", ErrorKind(err), "error", err)
+		pendingUploads = true
+	}
+
+	slog.Info("successfully imported a new tier", "tiers", transaction.Uuid, "code", p.tiers.Code, "label", p.tiers.Label)
+
+	for _, w := range transaction.PlateWarnings {
+		slog.Warn("plate anomaly", "transaction", transaction.Uuid, "kind", w.Kind, "plate", w.Plate, "message", w.Message)
+	}
+
+	out = &Outcome{TiersCode: p.tiers.Code, Warnings: transaction.PlateWarnings, PendingUploads: pendingUploads}
+	for _, pa := range p.passes {
+		out.ParkCodes = append(out.ParkCodes, pa.ParkCode)
+	}
+	return out, nil
+}
+
+// TransactionUUIDs returns the uuids of the transactions whose webhook was
+// stored, by transaction ID. Transactions found in a CSV export are keyed with
+// them, so that they are recognized when already imported from their webhook.
+func (im *Importer) TransactionUUIDs() (map[int]string, error) {
+	events, err := im.DB.ListWebhookEvents(database.EventFilter{})
+	if err != nil {
+		return nil, fmt.Errorf("unable to list webhook events: %w", err)
+	}
+
+	uuids := map[int]string{}
+	for _, ev := range events {
+		p := Payload{}
+		if err := json.Unmarshal(ev.Payload, &p); err != nil || p.Transaction.ID == 0 || p.Transaction.Uuid == "" {
+			continue
+		}
+		uuids[p.Transaction.ID] = p.Transaction.Uuid
+	}
+	return uuids, nil
+}
+
+// parse decodes and sanitizes a webhook payload, applying the overrides if
+// any. For payloads that are neither a confirmed transaction to import nor a
+// reversal, it returns a nil transaction and the reason why they are ignored.
+// A transaction that fails validation is reported with a *ValidationError.
+func (im *Importer) parse(ctx context.Context, body []byte, overrides *Overrides) (*payrexx.Transaction, string, error) {
+	_, span := tracing.Start(ctx, "DecodePayload")
+	formData := Payload{}
+	if err := json.Unmarshal(body, &formData); err != nil {
+		err = failure.NewPermanent(fmt.Errorf("error parsing JSON: %v", err))
+		tracing.End(span, err)
+		return nil, "", err
+	}
+	span.SetAttributes(tracing.TransactionUUID.String(formData.Transaction.Uuid))
+	span.End()
+
+	if formData.Payout.Status != "" {
+		return nil, "payout data", nil
+	}
+
+	if formData.Transaction.Invoice.ReferenceID != "" {
+		return nil, "invoice for weighing entries", nil
+	}
+
+	transaction := formData.Transaction
+	fields := transaction.CustomFields()
+	overrides.apply(&fields)
+	_, span = tracing.Start(ctx, "SanitizeFields", tracing.TransactionUUID.String(transaction.Uuid))
+	err := transaction.Sanitize(fields, im.IsBadge)
+	tracing.End(span, err)
+
+	if payrexx.IsReversal(transaction.Status) {
+		return &transaction, "", nil
+	}
+
+	if transaction.Status != payrexx.StatusConfirmed {
+		return nil, "uncompleted transaction with status " + transaction.Status, nil
+	}
+
+	if err != nil {
+		return nil, "", newValidationError(err)
+	}
+	return &transaction, "", nil
+}
+
+// IsBadge reports whether the product is in the catalog.
+func (im *Importer) IsBadge(p payrexx.Product) bool {
+	_, ok := im.Config.LookupProduct(p.Name, p.SKU)
+	return ok
+}
+
+// lockCustomer makes sure the transactions of a customer are handled one at a
+// time, across all replicas. It starts the database transaction the import
+// must run in, which holds the lock until rolled back, and returns the client
+// hash the customer is recorded with.
+func (im *Importer) lockCustomer(ctx context.Context, email string) (_ database.Tx, clientHash string, err error) {
+	_, span := tracing.Start(ctx, "LockCustomer")
+	defer func() { tracing.End(span, err) }()
+
+	tx, err := im.DB.Begin(ctx, im.customerLock(email), lockTimeout)
+	if err != nil {
+		return nil, "", fmt.Errorf("unable to lock customer: %w", err)
+	}
+	clientHash, err = im.clientHash(tx, email)
+	if err != nil {
+		tx.Rollback()
+		return nil, "", err
+	}
+	return tx, clientHash, nil
+}
+
+// customerLock names the lock of a customer after their current hash, which
+// does not change while the records are rewritten, see Rehash. The prefix is
+// kept short for the name to fit in database.MaxLockName with the longest key
+// IDs.
+func (im *Importer) customerLock(email string) string {
+	return "customer:" + im.Hasher.Hash(email)
+}
+
+// clientHash returns the hash the customer with the email is recorded with.
+// Customers recorded with a previous key keep their hash until the rehash
+// command rewrites it, new customers get the current hash.
+func (im *Importer) clientHash(q database.Queries, email string) (string, error) {
+	candidates := im.Hasher.Candidates(email)
+	if len(candidates) == 1 {
+		return candidates[0], nil
+	}
+	for _, h := range candidates {
+		exists, err := q.ClientHashExists(h)
+		if err != nil {
+			return "", fmt.Errorf("database error: %w", err)
+		}
+		if exists {
+			return h, nil
+		}
+	}
+	return candidates[0], nil
+}
+
+func (im *Importer) put(ctx context.Context, path string, data []byte) (err error) {
+	ctx, span := tracing.Start(ctx, "PutObject", attribute.String("sink", im.Sink.String()), attribute.String("object", path))
+	defer func() { tracing.End(span, err) }()
+
+	start := time.Now()
+	err = im.Sink.Put(ctx, path, data)
+	metrics.ObserveUpload(start, err)
+	if err != nil {
+		slog.Error("unable to put json file on import sink", "sink", im.Sink, "object", path, "error", err)
+		return err
+	}
+	return nil
+}
+
+// ErrorKind classifies the errors of the import pipeline.
+func ErrorKind(err error) failure.Kind {
+	if k := failure.KindOf(err); k != failure.Unknown {
+		return k
+	}
+	return database.ErrorKind(err)
+}
@@ -0,0 +1,83 @@
+package webhook
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/clementnuss/truckflow-user-importer/internal/tracing"
+)
+
+// flush uploads the pending outbox entries of a transaction, or of every
+// transaction older than olderThan when transactionID is empty. The entries of
+// a transaction are uploaded in order, and the first failure stops that
+// transaction so that a pass import never lands before its tiers import.
+func (im *Importer) flush(ctx context.Context, transactionID string, olderThan time.Duration) (err error) {
+	ctx, span := tracing.Start(ctx, "FlushOutbox", tracing.TransactionUUID.String(transactionID))
+	defer func() { tracing.End(span, err) }()
+
+	entries, err := im.DB.PendingOutboxEntries(transactionID, olderThan)
+	if err != nil {
+		return fmt.Errorf("unable to list outbox entries: %w", err)
+	}
+
+	var errs []error
+	blocked := map[string]bool{}
+	for _, e := range entries {
+		if blocked[e.TransactionID] {
+			continue
+		}
+
+		if err := im.put(ctx, e.Path, e.Content); err != nil {
+			blocked[e.TransactionID] = true
+			errs = append(errs, fmt.Errorf("%s: %w", e.Path, err))
+			if err := im.DB.MarkOutboxFailedAttempt(e.ID, err); err != nil {
+				slog.Error("unable to update outbox entry", "object", e.Path, "error", err)
+			}
+			continue
+		}
+
+		if err := im.DB.MarkOutboxUploaded(e.ID); err != nil {
+			slog.Error("unable to update outbox entry", "object", e.Path, "error", err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Reconciler finishes imports whose files could not be uploaded right after
+// their database transaction was committed.
+type Reconciler struct {
+	Importer *Importer
+	// Interval is the delay between two reconciliations.
+	Interval time.Duration
+	// Grace leaves fresh entries to the importer that created them.
+	Grace time.Duration
+}
+
+func NewReconciler(im *Importer) *Reconciler {
+	return &Reconciler{
+		Importer: im,
+		Interval: time.Minute,
+		Grace:    time.Minute,
+	}
+}
+
+// Run reconciles the outbox periodically until ctx is cancelled.
+func (rc *Reconciler) Run(ctx context.Context) {
+	t := time.NewTicker(rc.Interval)
+	defer t.Stop()
+
+	for {
+		if err := rc.Importer.flush(ctx, "", rc.Grace); err != nil {
+			slog.Error("outbox reconciliation failed", "error", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
@@ -0,0 +1,293 @@
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/clementnuss/truckflow-user-importer/internal/config"
+	"github.com/clementnuss/truckflow-user-importer/internal/database"
+	"github.com/clementnuss/truckflow-user-importer/internal/payrexx"
+	"github.com/clementnuss/truckflow-user-importer/internal/plates"
+	"github.com/clementnuss/truckflow-user-importer/internal/tracing"
+	"github.com/clementnuss/truckflow-user-importer/internal/truckflow"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// File is a Truckflow import file, named after its path in the import sink.
+type File struct {
+	Path    string          `json:"path"`
+	Content json.RawMessage `json:"content"`
+}
+
+// plan is everything an import records for a transaction.
+type plan struct {
+	// newTiers is set when the tiers is created rather than updated.
+	newTiers bool
+	tiers    truckflow.Tiers
+	customer database.Customer
+	passes   []database.Pass
+	files    []File
+}
+
+// plan builds the tiers and pass imports of a confirmed transaction. Codes are
+// obtained from allocate, which returns the first of n consecutive values of
+// a counter.
+func (im *Importer) plan(db database.Queries, transaction payrexx.Transaction, clientHash string, allocate func(counter string, n int) (int, error)) (*plan, error) {
+	tf := im.Config.Truckflow
+
+	tiersCode, err := im.existingTiersCode(db, clientHash, transaction)
+	if err != nil {
+		return nil, fmt.Errorf("unable to look up existing customer: %w", err)
+	}
+
+	// returning customers keep their tiers, which is imported again to
+	// update their details. Files are then named after the transaction as
+	// well, as the tiers code alone is not unique anymore.
+	fileSuffix := tiersCode + "_" + transaction.Uuid
+	newTiers := tiersCode == ""
+	if newTiers {
+		clientCounter, err := allocate("client", 1)
+		if err != nil {
+			return nil, fmt.Errorf("unable to allocate a client code: %w", err)
+		}
+		tiersCode = tf.TiersCode(clientCounter)
+		fileSuffix = tiersCode
+	} else {
+		slog.Info("reusing the tiers of a returning customer", "transaction", transaction.Uuid, "code", tiersCode)
+	}
+
+	// badges bought, in invoice order
+	products := []config.Product{}
+	quantities := []int{}
+	total := 0
+	for _, p := range transaction.Invoice.Products {
+		product, _ := im.Config.LookupProduct(p.Name, p.SKU)
+		products = append(products, product)
+		quantities = append(quantities, p.Quantity)
+		total += p.Quantity
+	}
+
+	productCodes, err := tiersProductCodes(db, tiersCode, products)
+	if err != nil {
+		return nil, fmt.Errorf("unable to retrieve the products of the tiers: %w", err)
+	}
+
+	// tier creation
+	tiers := truckflow.Tiers{
+		Type:         tf.TiersType,
+		Active:       true,
+		Address:      transaction.Contact.StreetAndNo,
+		ZIPCode:      transaction.Contact.ZIPCode,
+		City:         transaction.Contact.City,
+		Telephone:    transaction.Contact.Telephone,
+		Email:        transaction.Contact.Email,
+		Code:         tiersCode,
+		ProductCodes: productCodes,
+	}
+
+	if transaction.Contact.ClientType == payrexx.Company {
+		tiers.Label = transaction.Contact.Company
+		tiers.ContactPerson = transaction.Contact.FirstName + " " + transaction.Contact.LastName
+	} else {
+		tiers.Label = transaction.Contact.FirstName + " " + transaction.Contact.LastName
+	}
+
+	p := plan{
+		newTiers: newTiers,
+		tiers:    tiers,
+		customer: database.Customer{
+			TiersCode:     tiers.Code,
+			ClientHash:    clientHash,
+			Label:         tiers.Label,
+			ClientType:    int(transaction.Contact.ClientType),
+			ContactPerson: tiers.ContactPerson,
+			Address:       tiers.Address,
+			ZIPCode:       tiers.ZIPCode,
+			City:          tiers.City,
+			Telephone:     tiers.Telephone,
+		},
+	}
+
+	truckflowImport := truckflow.TiersImport{
+		Version: tf.Version,
+		Items:   []truckflow.Tiers{tiers},
+	}
+
+	jsonData, err := json.Marshal(truckflowImport)
+	if err != nil {
+		return nil, fmt.Errorf("error marshaling JSON for tier: %w", err)
+	}
+	p.files = append(p.files, File{
+		Path:    filepath.Join("importer/", fmt.Sprintf("tiers_import_%s.json", fileSuffix)),
+		Content: jsonData,
+	})
+
+	// pass creation
+	passImport := truckflow.PassImport{
+		Version: tf.Version,
+		Culture: tf.Culture,
+	}
+	passCounter, err := allocate("pass", total)
+	if err != nil {
+		return nil, fmt.Errorf("unable to allocate pass codes: %w", err)
+	}
+
+	// one pass per plate and per badge. SanitizeFields keeps as many plates
+	// as the largest quantity
+	type badge struct {
+		product config.Product
+		plate   string
+	}
+	badges := []badge{}
+	for i, product := range products {
+		for _, pl := range transaction.Plates[:quantities[i]] {
+			badges = append(badges, badge{product, pl})
+		}
+	}
+
+	for i, b := range badges {
+		pa := truckflow.NewPass(b.product.FlowType, b.product.ProductCode)
+		pa.Plate = b.plate
+		pa.ParkCode = tf.ParkCode(passCounter + i)
+		pa.Label = pa.ParkCode
+		pa.TiersCode = tiers.Code
+
+		switch transaction.Contact.ClientType {
+		case payrexx.Company:
+			pa.CompanyCode = tf.CompanyCodes.Company
+		case payrexx.Individual:
+			pa.CompanyCode = tf.CompanyCodes.Individual
+		default:
+			slog.Error("unknown client type. assigning individual type", "transactionId", transaction.Uuid)
+			pa.CompanyCode = tf.CompanyCodes.Individual
+		}
+		passImport.Items = append(passImport.Items, *pa)
+
+		p.passes = append(p.passes, database.Pass{
+			ParkCode:      pa.ParkCode,
+			Plate:         pa.Plate,
+			TiersCode:     pa.TiersCode,
+			TransactionID: transaction.Uuid,
+			CompanyCode:   pa.CompanyCode,
+			ProductCode:   pa.ProductCode,
+			FlowType:      pa.FlowType,
+			Active:        true,
+		})
+	}
+	jsonData, err = json.Marshal(passImport)
+	if err != nil {
+		return nil, fmt.Errorf("error marshaling JSON for pass: %w", err)
+	}
+	p.files = append(p.files, File{
+		Path:    filepath.Join("importer/", fmt.Sprintf("pass_import_%s.json", fileSuffix)),
+		Content: jsonData,
+	})
+
+	return &p, nil
+}
+
+// Preview is what importing a payload would produce.
+type Preview struct {
+	// Ignored is the reason why the payload would not be imported.
+	Ignored string `json:"ignored,omitempty"`
+	// AlreadyProcessed is set when the transaction would be skipped unless
+	// forced.
+	AlreadyProcessed bool `json:"already_processed,omitempty"`
+	// Files are the Truckflow imports that would be uploaded. Codes are the
+	// next free ones at the time of the preview.
+	Files []File `json:"files,omitempty"`
+	// Warnings are the anomalies found in the plates of the transaction.
+	Warnings []plates.Warning `json:"warnings,omitempty"`
+}
+
+// Preview runs the import pipeline for a raw webhook payload without any side
+// effect: counters are only read, and nothing is written to the database or
+// to the import sink.
+func (im *Importer) Preview(ctx context.Context, body []byte) (*Preview, error) {
+	ctx, span := tracing.Start(ctx, "Preview")
+	defer span.End()
+
+	transaction, reason, err := im.parse(ctx, body, nil)
+	if err != nil {
+		return nil, err
+	}
+	if transaction == nil {
+		return &Preview{Ignored: reason}, nil
+	}
+	if payrexx.IsReversal(transaction.Status) {
+		return &Preview{Ignored: "reversal, the passes of the transaction would be deactivated"}, nil
+	}
+
+	clientHash, err := im.clientHash(im.DB, transaction.Contact.Email)
+	if err != nil {
+		return nil, err
+	}
+
+	_, processedSpan := tracing.Start(ctx, "IsTransactionProcessed")
+	processed, err := im.DB.IsTransactionProcessed(clientHash, transaction.Uuid)
+	tracing.End(processedSpan, err)
+	if err != nil {
+		return nil, fmt.Errorf("database error: %w", err)
+	}
+
+	p, err := im.plan(im.DB, *transaction, clientHash, func(counter string, n int) (int, error) {
+		_, span := tracing.Start(ctx, "PeekCounter", attribute.String("counter", counter))
+		v, err := im.DB.PeekCounter(counter)
+		tracing.End(span, err)
+		return v + 1, err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &Preview{AlreadyProcessed: processed, Files: p.files, Warnings: transaction.PlateWarnings}, nil
+}
+
+// tiersProductCodes lists the product codes the tiers is allowed to deliver:
+// the ones of its active passes and of the badges being bought.
+func tiersProductCodes(db database.Queries, tiersCode string, products []config.Product) (string, error) {
+	codes := []string{}
+	if tiersCode != "" {
+		passes, err := db.TiersPasses(tiersCode)
+		if err != nil {
+			return "", err
+		}
+		for _, p := range passes {
+			if p.Active {
+				codes = append(codes, p.ProductCode)
+			}
+		}
+	}
+	for _, p := range products {
+		codes = append(codes, p.ProductCode)
+	}
+
+	slices.Sort(codes)
+	return strings.Join(slices.Compact(codes), ","), nil
+}
+
+// existingTiersCode looks up the tiers of a returning customer, preferably
+// with the client number given in the transaction, as long as it belongs to
+// the same email address. It returns an empty string for new customers.
+func (im *Importer) existingTiersCode(db database.Queries, clientHash string, transaction payrexx.Transaction) (string, error) {
+	if transaction.ClientNumber != "" {
+		code := transaction.ClientNumber
+		if n, err := strconv.Atoi(code); err == nil {
+			code = im.Config.Truckflow.TiersCode(n)
+		}
+
+		tiersCode, err := db.CustomerTiersCode(clientHash, code)
+		if err != nil || tiersCode != "" {
+			return tiersCode, err
+		}
+		slog.Warn("client number does not belong to the customer, ignoring it", "transaction", transaction.Uuid, "client_number", transaction.ClientNumber)
+	}
+
+	return db.CustomerTiersCode(clientHash, "")
+}
@@ -0,0 +1,440 @@
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/clementnuss/truckflow-user-importer/internal/database"
+	"github.com/clementnuss/truckflow-user-importer/internal/truckflow"
+)
+
+// PrivacyBundle is everything held about a customer, as returned to a data
+// access request.
+type PrivacyBundle struct {
+	Email        string                     `json:"email"`
+	ClientHashes []string                   `json:"client_hashes"`
+	Customers    []database.Customer        `json:"customers"`
+	Transactions []database.ProcessedRecord `json:"transactions"`
+	Passes       []database.Pass            `json:"passes"`
+	// ImportFiles are the files written to the import sink, as recorded in
+	// the outbox, and the imports of the tiers found in the sink. The content
+	// of the latter, written before the outbox existed, is not known.
+	ImportFiles     []PrivacyFile             `json:"import_files"`
+	WebhookEvents   []PrivacyEvent            `json:"webhook_events"`
+	PrivacyRequests []database.PrivacyRequest `json:"privacy_requests"`
+
+	// transactionIDs are the transactions of the customer, recorded or
+	// not.
+	transactionIDs []string
+}
+
+// PrivacyFile is an import file.
+type PrivacyFile struct {
+	Path    string          `json:"path"`
+	Content json.RawMessage `json:"content,omitempty"`
+}
+
+// PrivacyEvent is a stored webhook payload.
+type PrivacyEvent struct {
+	ID              int64           `json:"id"`
+	TransactionUUID string          `json:"transaction_uuid"`
+	Status          string          `json:"status"`
+	ReceivedAt      time.Time       `json:"received_at"`
+	Payload         json.RawMessage `json:"payload"`
+	Overrides       json.RawMessage `json:"overrides,omitempty"`
+}
+
+// PrivacySummary is what a privacy request was about, kept in its audit
+// record.
+type PrivacySummary struct {
+	TiersCodes    []string `json:"tiers_codes"`
+	Transactions  int      `json:"transactions"`
+	Passes        int      `json:"passes"`
+	ImportFiles   int      `json:"import_files"`
+	WebhookEvents int      `json:"webhook_events"`
+}
+
+func (b *PrivacyBundle) summary() PrivacySummary {
+	return PrivacySummary{
+		TiersCodes:    b.tiersCodes(),
+		Transactions:  len(b.Transactions),
+		Passes:        len(b.Passes),
+		ImportFiles:   len(b.ImportFiles),
+		WebhookEvents: len(b.WebhookEvents),
+	}
+}
+
+func (b *PrivacyBundle) tiersCodes() []string {
+	codes := []string{}
+	for _, c := range b.Customers {
+		codes = append(codes, c.TiersCode)
+	}
+	for _, r := range b.Transactions {
+		if r.TiersCode != "" {
+			codes = append(codes, r.TiersCode)
+		}
+	}
+	slices.Sort(codes)
+	return slices.Compact(codes)
+}
+
+// ExportCustomer collects everything held about the customer with the email,
+// and records the request in the audit trail.
+func (im *Importer) ExportCustomer(ctx context.Context, email, operator, reason string) (*PrivacyBundle, error) {
+	// as imported, see payrexx.Transaction.Sanitize
+	email = strings.TrimSpace(email)
+	b, err := im.collect(ctx, im.DB, email)
+	if err != nil {
+		return nil, err
+	}
+	if err := im.auditPrivacy(im.DB, database.PrivacyExport, email, operator, reason, b.summary()); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// collect gathers the records of every hash the customer may be recorded
+// with, the webhook events of their transactions or sent with their email, and
+// their import files.
+func (im *Importer) collect(ctx context.Context, q database.Queries, email string) (*PrivacyBundle, error) {
+	b := &PrivacyBundle{
+		Email:           email,
+		ClientHashes:    im.Hasher.Candidates(email),
+		Customers:       []database.Customer{},
+		Transactions:    []database.ProcessedRecord{},
+		Passes:          []database.Pass{},
+		ImportFiles:     []PrivacyFile{},
+		WebhookEvents:   []PrivacyEvent{},
+		PrivacyRequests: []database.PrivacyRequest{},
+	}
+
+	transactions := map[string]bool{}
+	for _, h := range b.ClientHashes {
+		customers, err := q.FindCustomers(h, "")
+		if err != nil {
+			return nil, fmt.Errorf("unable to retrieve customers: %w", err)
+		}
+		b.Customers = append(b.Customers, customers...)
+
+		records, err := q.ClientTransactions(h)
+		if err != nil {
+			return nil, fmt.Errorf("unable to retrieve transactions: %w", err)
+		}
+		b.Transactions = append(b.Transactions, records...)
+		for _, r := range records {
+			transactions[r.TransactionID] = true
+		}
+
+		requests, err := q.ListPrivacyRequests(h)
+		if err != nil {
+			return nil, fmt.Errorf("unable to retrieve privacy requests: %w", err)
+		}
+		b.PrivacyRequests = append(b.PrivacyRequests, requests...)
+	}
+
+	for _, code := range b.tiersCodes() {
+		passes, err := q.TiersPasses(code)
+		if err != nil {
+			return nil, fmt.Errorf("unable to retrieve passes: %w", err)
+		}
+		b.Passes = append(b.Passes, passes...)
+	}
+
+	events, err := im.customerEvents(email, transactions)
+	if err != nil {
+		return nil, err
+	}
+	for _, ev := range events {
+		transactions[ev.TransactionUUID] = true
+		b.WebhookEvents = append(b.WebhookEvents, PrivacyEvent{
+			ID:              ev.ID,
+			TransactionUUID: ev.TransactionUUID,
+			Status:          ev.Status,
+			ReceivedAt:      ev.ReceivedAt,
+			Payload:         rawJSON(ev.Payload),
+			Overrides:       rawJSON(ev.Overrides),
+		})
+	}
+
+	delete(transactions, "")
+	b.transactionIDs = slices.Sorted(maps.Keys(transactions))
+	recorded := map[string]bool{}
+	for _, id := range b.transactionIDs {
+		entries, err := q.TransactionOutboxEntries(id)
+		if err != nil {
+			return nil, fmt.Errorf("unable to retrieve outbox entries: %w", err)
+		}
+		for _, e := range entries {
+			recorded[e.Path] = true
+			b.ImportFiles = append(b.ImportFiles, PrivacyFile{Path: e.Path, Content: rawJSON(e.Content)})
+		}
+	}
+
+	for _, code := range b.tiersCodes() {
+		paths, err := im.tiersImports(ctx, code)
+		if err != nil {
+			return nil, err
+		}
+		for _, p := range paths {
+			if !recorded[p] {
+				b.ImportFiles = append(b.ImportFiles, PrivacyFile{Path: p})
+			}
+		}
+	}
+	return b, nil
+}
+
+// tiersImports lists the tiers and pass imports of the tiers found in the
+// import sink: tiers_import_<code>.json and pass_import_<code>.json as
+// written before the outbox existed, and those suffixed with the transaction
+// of a returning customer. The deactivation files are left out: those of
+// reversals are recorded in the outbox, as they were introduced with it, and
+// those of erasures hold no personal data.
+func (im *Importer) tiersImports(ctx context.Context, code string) ([]string, error) {
+	var paths []string
+	for _, kind := range []string{"tiers_import_", "pass_import_"} {
+		prefix := path.Join("importer", kind+code)
+		found, err := im.Sink.List(ctx, prefix)
+		if err != nil {
+			return nil, fmt.Errorf("unable to list the imports of tiers %s: %w", code, err)
+		}
+		for _, p := range found {
+			// skip the imports of the tiers whose code starts with this one
+			if rest := strings.TrimPrefix(p, prefix); rest == ".json" || strings.HasPrefix(rest, "_") {
+				paths = append(paths, p)
+			}
+		}
+	}
+	return paths, nil
+}
+
+// customerEvents returns the webhook events of the transactions, or whose
+// payload was sent with the email.
+func (im *Importer) customerEvents(email string, transactions map[string]bool) ([]database.WebhookEvent, error) {
+	all, err := im.DB.ListWebhookEvents(database.EventFilter{})
+	if err != nil {
+		return nil, fmt.Errorf("unable to list webhook events: %w", err)
+	}
+
+	hash := im.Hasher.Hash(email)
+	events := []database.WebhookEvent{}
+	for _, ev := range all {
+		p := Payload{}
+		if transactions[ev.TransactionUUID] ||
+			(json.Unmarshal(ev.Payload, &p) == nil && strings.TrimSpace(p.Transaction.Contact.Email) != "" && im.Hasher.Hash(strings.TrimSpace(p.Transaction.Contact.Email)) == hash) {
+			events = append(events, ev)
+		}
+	}
+	return events, nil
+}
+
+// ErasureResult tells what EraseCustomer did.
+type ErasureResult struct {
+	PrivacySummary
+	// PendingUploads is set when the deactivation files could not be
+	// uploaded yet. The Reconciler takes care of them.
+	PendingUploads bool `json:"pending_uploads,omitempty"`
+	// Errors are the webhook events that could not be deleted after the
+	// erasure was recorded. Running it again deletes them.
+	Errors []string `json:"errors,omitempty"`
+}
+
+// EraseCustomer removes the personal data held about the customer with the
+// email, and records the request in the audit trail:
+//   - their tiers and passes are deactivated in Truckflow, the tiers being
+//     sent without contact details;
+//   - their customer records are deleted, and the plates of their passes
+//     cleared;
+//   - their import files are removed from the import sink and the outbox;
+//   - their webhook events are deleted.
+//
+// The transactions stay recorded, by client hash only, so that they are not
+// imported again if Payrexx delivers them again.
+func (im *Importer) EraseCustomer(ctx context.Context, email, operator, reason string) (*ErasureResult, error) {
+	email = strings.TrimSpace(email)
+	tx, _, err := im.lockCustomer(ctx, email)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	b, err := im.collect(ctx, tx, email)
+	if err != nil {
+		return nil, err
+	}
+	res := &ErasureResult{PrivacySummary: b.summary()}
+
+	erasureID := "erasure-" + time.Now().UTC().Format("20060102150405.000000")
+	var files []database.OutboxEntry
+	for _, code := range res.TiersCodes {
+		tiersFiles, err := im.erasureFiles(tx, code, erasureID)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, tiersFiles...)
+	}
+
+	// the files deactivating the tiers replace those of the customer
+	for _, id := range b.transactionIDs {
+		if err := tx.DeleteTransactionOutboxEntries(id); err != nil {
+			return nil, fmt.Errorf("unable to delete outbox entries: %w", err)
+		}
+		if err := tx.DeactivateTransactionPasses(id); err != nil {
+			return nil, fmt.Errorf("unable to deactivate passes: %w", err)
+		}
+	}
+	for _, code := range res.TiersCodes {
+		if err := tx.AnonymizeTiers(code); err != nil {
+			return nil, fmt.Errorf("unable to anonymize tiers %s: %w", code, err)
+		}
+	}
+	for _, f := range files {
+		if err := tx.AddOutboxEntry(erasureID, f.Path, f.Content); err != nil {
+			return nil, fmt.Errorf("unable to record %s in outbox: %w", f.Path, err)
+		}
+	}
+
+	// the files are removed while their outbox entries can still be found,
+	// so that a failed erasure can simply be run again
+	for _, f := range b.ImportFiles {
+		if err := im.Sink.Remove(ctx, f.Path); err != nil {
+			return nil, fmt.Errorf("unable to remove %s from the import sink: %w", f.Path, err)
+		}
+	}
+
+	if err := im.auditPrivacy(tx, database.PrivacyErase, email, operator, reason, res.PrivacySummary); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("unable to commit erasure: %w", err)
+	}
+
+	if err := im.flush(ctx, erasureID, 0); err != nil {
+		slog.Warn("deactivation files not uploaded yet", "erasure", erasureID, "error", err)
+		res.PendingUploads = true
+	}
+	for _, ev := range b.WebhookEvents {
+		if err := im.DB.DeleteWebhookEvent(ev.ID); err != nil {
+			res.Errors = append(res.Errors, fmt.Sprintf("event %d: %v", ev.ID, err))
+		}
+	}
+
+	slog.Info("erased customer data", "erasure", erasureID, "tiers", res.TiersCodes, "transactions", res.Transactions, "errors", len(res.Errors))
+	return res, nil
+}
+
+// erasureFiles are the Truckflow imports deactivating the tiers and its
+// active passes. The passes are identified by their park code, without their
+// plate, and the tiers is sent back as it was last imported, without its
+// contact details.
+func (im *Importer) erasureFiles(q database.Queries, code, erasureID string) ([]database.OutboxEntry, error) {
+	var files []database.OutboxEntry
+
+	passes, err := q.TiersPasses(code)
+	if err != nil {
+		return nil, fmt.Errorf("unable to retrieve the passes of the tiers: %w", err)
+	}
+	passImport := truckflow.PassImport{
+		Version: im.Config.Truckflow.Version,
+		Culture: im.Config.Truckflow.Culture,
+	}
+	for _, p := range passes {
+		if !p.Active {
+			continue
+		}
+		passImport.Items = append(passImport.Items, truckflow.Pass{
+			ParkCode:    p.ParkCode,
+			Label:       p.ParkCode,
+			FlowType:    p.FlowType,
+			CompanyCode: p.CompanyCode,
+			TiersCode:   p.TiersCode,
+			ProductCode: p.ProductCode,
+			Active:      false,
+		})
+	}
+	if len(passImport.Items) > 0 {
+		jsonData, err := json.Marshal(passImport)
+		if err != nil {
+			return nil, fmt.Errorf("error marshaling JSON for pass: %w", err)
+		}
+		files = append(files, database.OutboxEntry{
+			Path:    filepath.Join("importer/", fmt.Sprintf("pass_deactivation_%s_%s.json", code, erasureID)),
+			Content: jsonData,
+		})
+	}
+
+	tiers := truckflow.Tiers{Type: im.Config.Truckflow.TiersType, Code: code}
+	content, err := q.LatestOutboxContent(filepath.Join("importer/", fmt.Sprintf("tiers_import_%s", code)))
+	if err != nil {
+		return nil, fmt.Errorf("unable to retrieve the tiers import: %w", err)
+	}
+	if content != nil {
+		tiersImport := truckflow.TiersImport{}
+		if err := json.Unmarshal(content, &tiersImport); err != nil {
+			return nil, fmt.Errorf("unable to parse the tiers import: %w", err)
+		}
+		if len(tiersImport.Items) > 0 {
+			tiers = tiersImport.Items[0]
+		}
+	}
+	tiers.Label = code
+	tiers.Address, tiers.ZIPCode, tiers.City, tiers.Telephone, tiers.Email, tiers.ContactPerson = "", "", "", "", "", ""
+	tiers.Active = false
+
+	jsonData, err := json.Marshal(truckflow.TiersImport{
+		Version: im.Config.Truckflow.Version,
+		Culture: im.Config.Truckflow.Culture,
+		Items:   []truckflow.Tiers{tiers},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error marshaling JSON for tier: %w", err)
+	}
+	return append(files, database.OutboxEntry{
+		Path:    filepath.Join("importer/", fmt.Sprintf("tiers_deactivation_%s_%s.json", code, erasureID)),
+		Content: jsonData,
+	}), nil
+}
+
+// auditPrivacy records a privacy request, identifying the customer by their
+// current client hash.
+func (im *Importer) auditPrivacy(q database.Queries, kind, email, operator, reason string, summary PrivacySummary) error {
+	if operator == "" {
+		return errors.New("the operator handling the request must be given")
+	}
+	details, err := json.Marshal(summary)
+	if err != nil {
+		return err
+	}
+	err = q.RecordPrivacyRequest(database.PrivacyRequest{
+		Kind:       kind,
+		ClientHash: im.Hasher.Hash(email),
+		Operator:   operator,
+		Reason:     reason,
+		Details:    details,
+	})
+	if err != nil {
+		return fmt.Errorf("unable to record privacy request: %w", err)
+	}
+	return nil
+}
+
+// rawJSON embeds stored JSON as is, and anything else as a string.
+func rawJSON(data []byte) json.RawMessage {
+	if len(data) == 0 {
+		return nil
+	}
+	if json.Valid(data) {
+		return data
+	}
+	s, _ := json.Marshal(string(data))
+	return s
+}
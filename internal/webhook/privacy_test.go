@@ -0,0 +1,103 @@
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"testing"
+
+	"github.com/clementnuss/truckflow-user-importer/internal/database"
+	"github.com/clementnuss/truckflow-user-importer/internal/sink"
+	"github.com/clementnuss/truckflow-user-importer/internal/truckflow"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPrivacy(t *testing.T) {
+	ctx := context.Background()
+	pool, _ := testPool(t)
+	im := pool.Importer
+	dir := t.TempDir()
+	im.Sink = sink.NewDir(dir)
+
+	code, res := deliver(t, pool, importPayload)
+	require.Equal(t, http.StatusOK, code)
+	require.Equal(t, "imported", res.Status)
+	// imports written before the outbox existed, of the customer and of
+	// another one
+	require.NoError(t, im.Sink.Put(ctx, "importer/pass_import_00001_b2a8e3d1.json", []byte("{}")))
+	require.NoError(t, im.Sink.Put(ctx, "importer/tiers_import_000010.json", []byte("{}")))
+
+	_, err := im.ExportCustomer(ctx, "some@email.ch", "", "")
+	assert.Error(t, err, "the operator is required")
+
+	bundle, err := im.ExportCustomer(ctx, " Some@Email.ch", "admin", "request 42")
+	require.NoError(t, err)
+	require.Len(t, bundle.Customers, 1)
+	assert.Equal(t, "Foo Bar", bundle.Customers[0].Label)
+	require.Len(t, bundle.Transactions, 1)
+	assert.Equal(t, "c7d4e1f0", bundle.Transactions[0].TransactionID)
+	require.Len(t, bundle.Passes, 1)
+	assert.Equal(t, "JU12345", bundle.Passes[0].Plate)
+	require.Len(t, bundle.ImportFiles, 3)
+	assert.Equal(t, "importer/pass_import_00001_b2a8e3d1.json", bundle.ImportFiles[2].Path)
+	assert.Nil(t, bundle.ImportFiles[2].Content)
+	require.Len(t, bundle.WebhookEvents, 1)
+	assert.Contains(t, string(bundle.WebhookEvents[0].Payload), "some@email.ch")
+	_, err = json.Marshal(bundle)
+	require.NoError(t, err)
+
+	erasure, err := im.EraseCustomer(ctx, "some@email.ch", "admin", "request 43")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"00001"}, erasure.TiersCodes)
+	assert.False(t, erasure.PendingUploads)
+	assert.Empty(t, erasure.Errors)
+
+	// the import files are replaced by the deactivation ones
+	files, err := filepath.Glob(filepath.Join(dir, "importer", "*.json"))
+	require.NoError(t, err)
+	require.Len(t, files, 3)
+	assert.Regexp(t, `pass_deactivation_00001_erasure-.*\.json$`, files[0])
+	assert.Regexp(t, `tiers_deactivation_00001_erasure-.*\.json$`, files[1])
+	assert.Equal(t, filepath.Join(dir, "importer", "tiers_import_000010.json"), files[2])
+	content, err := os.ReadFile(files[1])
+	require.NoError(t, err)
+	tiersImport := truckflow.TiersImport{}
+	require.NoError(t, json.Unmarshal(content, &tiersImport))
+	require.Len(t, tiersImport.Items, 1)
+	assert.Equal(t, truckflow.Tiers{Type: tiersImport.Items[0].Type, Code: "00001", Label: "00001", ProductCodes: tiersImport.Items[0].ProductCodes}, tiersImport.Items[0])
+
+	// the erasure does not copy the plates, to the sink or to the outbox
+	for _, f := range files {
+		content, err := os.ReadFile(f)
+		require.NoError(t, err)
+		assert.NotContains(t, string(content), "JU12345", f)
+	}
+	erasureID := regexp.MustCompile(`erasure-[0-9]+\.[0-9]+`).FindString(files[0])
+	entries, err := im.DB.TransactionOutboxEntries(erasureID)
+	require.NoError(t, err)
+	require.Len(t, entries, 2)
+	for _, e := range entries {
+		assert.NotContains(t, string(e.Content), "JU12345", e.Path)
+	}
+
+	bundle, err = im.ExportCustomer(ctx, "some@email.ch", "admin", "")
+	require.NoError(t, err)
+	assert.Empty(t, bundle.Customers)
+	assert.Empty(t, bundle.WebhookEvents)
+	require.Len(t, bundle.Passes, 1)
+	assert.Equal(t, "", bundle.Passes[0].Plate)
+	assert.False(t, bundle.Passes[0].Active)
+	require.Len(t, bundle.PrivacyRequests, 2)
+	assert.Equal(t, database.PrivacyExport, bundle.PrivacyRequests[0].Kind)
+	assert.Equal(t, database.PrivacyErase, bundle.PrivacyRequests[1].Kind)
+	assert.Equal(t, "request 43", bundle.PrivacyRequests[1].Reason)
+
+	// Payrexx delivering the payload again does not import the customer back
+	out, err := im.Import(ctx, []byte(importPayload), ImportOptions{})
+	require.NoError(t, err)
+	assert.True(t, out.AlreadyProcessed)
+}
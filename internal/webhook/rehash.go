@@ -0,0 +1,114 @@
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/clementnuss/truckflow-user-importer/internal/database"
+)
+
+// RehashResult tells what Rehash did.
+type RehashResult struct {
+	// Emails is the number of emails looked at.
+	Emails int
+	// Rewritten is the number of client hashes rewritten with the current
+	// key.
+	Rewritten int
+	// Stale is the number of client hashes still recorded with a previous
+	// key or the legacy hash, whose email is not known.
+	Stale int
+}
+
+// Rehash rewrites the client hashes recorded with a previous key or with the
+// legacy hash, so that previous keys can be dropped. Hashes cannot be
+// reversed: the emails are taken from the stored webhook payloads, along with
+// the given ones, e.g. those of the transactions imported from a CSV export.
+//
+// The records of each customer are rewritten in a single transaction, while
+// holding the lock of the customer, so that imports running meanwhile never
+// see a customer half rewritten.
+func (im *Importer) Rehash(ctx context.Context, emails []string) (*RehashResult, error) {
+	if !im.Hasher.Keyed() {
+		return nil, errors.New("CLIENT_HASH_KEYS is not set, there is no key to rewrite the hashes with")
+	}
+
+	events, err := im.DB.ListWebhookEvents(database.EventFilter{})
+	if err != nil {
+		return nil, fmt.Errorf("unable to list webhook events: %w", err)
+	}
+	for _, ev := range events {
+		p := Payload{}
+		if err := json.Unmarshal(ev.Payload, &p); err != nil {
+			continue
+		}
+		emails = append(emails, p.Transaction.Contact.Email)
+	}
+
+	res := &RehashResult{}
+	seen := map[string]bool{}
+	for _, email := range emails {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		// as imported, see payrexx.Transaction.Sanitize
+		email = strings.TrimSpace(email)
+		if email == "" || seen[email] {
+			continue
+		}
+		seen[email] = true
+		res.Emails += 1
+
+		n, err := im.rehashCustomer(ctx, email)
+		if err != nil {
+			return nil, err
+		}
+		res.Rewritten += n
+	}
+
+	hashes, err := im.DB.ClientHashes()
+	if err != nil {
+		return nil, fmt.Errorf("unable to list client hashes: %w", err)
+	}
+	for _, h := range hashes {
+		if !im.Hasher.IsCurrent(h) {
+			res.Stale += 1
+		}
+	}
+	return res, nil
+}
+
+// rehashCustomer rewrites the previous hashes of the customer with the email,
+// and returns how many were found.
+func (im *Importer) rehashCustomer(ctx context.Context, email string) (int, error) {
+	candidates := im.Hasher.Candidates(email)
+	tx, err := im.DB.Begin(ctx, im.customerLock(email), lockTimeout)
+	if err != nil {
+		return 0, fmt.Errorf("unable to lock customer: %w", err)
+	}
+	defer tx.Rollback()
+
+	n := 0
+	for _, h := range candidates[1:] {
+		exists, err := tx.ClientHashExists(h)
+		if err != nil {
+			return 0, fmt.Errorf("database error: %w", err)
+		}
+		if !exists {
+			continue
+		}
+		if err := tx.RehashClient(h, candidates[0]); err != nil {
+			return 0, fmt.Errorf("unable to rewrite client hash: %w", err)
+		}
+		n += 1
+	}
+	if n == 0 {
+		return 0, nil
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("unable to commit client hashes: %w", err)
+	}
+	return n, nil
+}
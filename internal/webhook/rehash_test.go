@@ -0,0 +1,66 @@
+package webhook
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/clementnuss/truckflow-user-importer/internal/clienthash"
+	"github.com/clementnuss/truckflow-user-importer/internal/database"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRehash(t *testing.T) {
+	ctx := context.Background()
+	pool, _ := testPool(t)
+	im := pool.Importer
+
+	// imported before keys were configured, from a payload whose email is
+	// surrounded with spaces
+	payload := strings.Replace(importPayload, `"email": "some@email.ch"`, `"email": " some@email.ch "`, 1)
+	im.Hasher = &clienthash.Hasher{}
+	out, err := im.Import(ctx, []byte(payload), ImportOptions{})
+	require.NoError(t, err)
+	require.Equal(t, "00001", out.TiersCode)
+
+	// the customer is still recognized with the legacy hash
+	im.Hasher = testHasher
+	out, err = im.Import(ctx, []byte(importPayload), ImportOptions{})
+	require.NoError(t, err)
+	assert.True(t, out.AlreadyProcessed)
+
+	_, _, err = im.DB.QueueWebhookEvent("c7d4e1f0", []byte(payload), 0)
+	require.NoError(t, err)
+	res, err := im.Rehash(ctx, []string{"unknown@email.ch"})
+	require.NoError(t, err)
+	assert.Equal(t, &RehashResult{Emails: 2, Rewritten: 1}, res)
+
+	exists, err := im.DB.ClientHashExists(clienthash.Legacy("some@email.ch"))
+	require.NoError(t, err)
+	assert.False(t, exists)
+	customers, err := im.DB.FindCustomers(testHasher.Hash(" Some@Email.ch"), "")
+	require.NoError(t, err)
+	assert.Len(t, customers, 1)
+
+	out, err = im.Import(ctx, []byte(importPayload), ImportOptions{})
+	require.NoError(t, err)
+	assert.True(t, out.AlreadyProcessed)
+
+	// without any key, there is nothing to rewrite the hashes with
+	im.Hasher = &clienthash.Hasher{}
+	_, err = im.Rehash(ctx, nil)
+	assert.Error(t, err)
+}
+
+func TestLongestKeyID(t *testing.T) {
+	pool, _ := testPool(t)
+	im := pool.Importer
+	im.Hasher = &clienthash.Hasher{Keys: []clienthash.Key{{ID: strings.Repeat("k", 16), Secret: []byte("0123456789abcdef")}}}
+	require.NoError(t, im.Hasher.Validate())
+
+	assert.LessOrEqual(t, len(im.customerLock("some@email.ch")), database.MaxLockName)
+	out, err := im.Import(context.Background(), []byte(importPayload), ImportOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, "00001", out.TiersCode)
+}
@@ -0,0 +1,129 @@
+package webhook
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/clementnuss/truckflow-user-importer/internal/database"
+	"github.com/clementnuss/truckflow-user-importer/internal/failure"
+)
+
+// ReplayResult is the outcome of replaying a single webhook event.
+type ReplayResult struct {
+	Event       int64    `json:"event"`
+	Transaction string   `json:"transaction"`
+	Error       string   `json:"error,omitempty"`
+	Outcome     *Outcome `json:"outcome,omitempty"`
+}
+
+// ReplayFilter builds the event selection for a replay. At least one of
+// transaction, from/to or failed must be given, so that a replay never runs
+// over the whole history by accident. Times are either RFC 3339 or plain
+// dates.
+func ReplayFilter(transaction, from, to string, failed bool) (database.EventFilter, error) {
+	filter := database.EventFilter{TransactionUUID: transaction}
+	if failed {
+		filter.Status = database.EventFailed
+	}
+
+	var err error
+	if filter.From, err = parseTime(from); err != nil {
+		return filter, fmt.Errorf("invalid from time: %w", err)
+	}
+	if filter.To, err = parseTime(to); err != nil {
+		return filter, fmt.Errorf("invalid to time: %w", err)
+	}
+
+	if filter.TransactionUUID == "" && filter.From.IsZero() && filter.To.IsZero() && filter.Status == "" {
+		return filter, errors.New("a transaction, a time range or the failed state must be selected")
+	}
+	return filter, nil
+}
+
+func parseTime(v string) (time.Time, error) {
+	if v == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, v); err == nil {
+		return t, nil
+	}
+	return time.ParseInLocation(time.DateOnly, v, time.Local)
+}
+
+// ErrEventClaimed is returned for an event claimed by someone else, e.g. a
+// worker of the Pool importing it.
+var ErrEventClaimed = errors.New("event is being processed")
+
+// claim claims an event read outside of the Pool, so that no worker imports
+// it meanwhile. The returned context ends with the lease.
+func (im *Importer) claim(ctx context.Context, ev *database.WebhookEvent) (context.Context, context.CancelFunc, error) {
+	claimed, err := im.DB.ReclaimWebhookEvent(ev, defaultLease)
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to claim webhook event: %w", err)
+	}
+	if !claimed {
+		return nil, nil, ErrEventClaimed
+	}
+	ctx, cancel := context.WithTimeout(ctx, defaultLease)
+	return ctx, cancel, nil
+}
+
+// Replay runs the import pipeline again for every stored event matching
+// filter, and updates the event status accordingly. Already processed
+// transactions are skipped unless force is set, as well as the events being
+// processed meanwhile.
+func (im *Importer) Replay(ctx context.Context, filter database.EventFilter, force bool) ([]ReplayResult, error) {
+	events, err := im.DB.ListWebhookEvents(filter)
+	if err != nil {
+		return nil, fmt.Errorf("unable to list webhook events: %w", err)
+	}
+
+	results := []ReplayResult{}
+	for _, ev := range events {
+		if err := ctx.Err(); err != nil {
+			return results, err
+		}
+		results = append(results, im.replay(ctx, &ev, force))
+	}
+	return results, nil
+}
+
+func (im *Importer) replay(ctx context.Context, ev *database.WebhookEvent, force bool) ReplayResult {
+	res := ReplayResult{Event: ev.ID, Transaction: ev.TransactionUUID}
+	ctx, cancel, err := im.claim(ctx, ev)
+	if err != nil {
+		res.Error = err.Error()
+		slog.Warn("skipping replay of webhook event", "event", ev.ID, "transaction", ev.TransactionUUID, "error", err)
+		return res
+	}
+	defer cancel()
+
+	overrides, err := eventOverrides(ev)
+	if err == nil {
+		res.Outcome, err = im.Import(ctx, ev.Payload, ImportOptions{Force: force, Overrides: overrides})
+	}
+	var ve *ValidationError
+	if errors.As(err, &ve) {
+		res.Error = err.Error()
+		slog.Warn("replayed webhook event needs a review", "event", ev.ID, "transaction", ev.TransactionUUID, "problems", ve.Problems)
+		err = im.DB.ReviewWebhookEvent(ev.ID, err)
+	} else if err != nil && ErrorKind(err) == failure.Permanent {
+		res.Error = err.Error()
+		slog.Error("replayed webhook event rejected", "event", ev.ID, "transaction", ev.TransactionUUID, "error", err)
+		err = im.DB.RejectWebhookEvent(ev.ID, err)
+	} else if err != nil {
+		res.Error = err.Error()
+		slog.Error("replay failed", "event", ev.ID, "transaction", ev.TransactionUUID, "error", err)
+		err = im.DB.FailWebhookEvent(ev.ID, err)
+	} else {
+		slog.Info("replayed webhook event", "event", ev.ID, "transaction", ev.TransactionUUID, "force", force)
+		err = im.DB.CompleteWebhookEvent(ev.ID)
+	}
+	if err != nil {
+		slog.Error("unable to update webhook event status", "event", ev.ID, "error", err)
+	}
+	return res
+}
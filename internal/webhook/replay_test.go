@@ -0,0 +1,59 @@
+package webhook
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/clementnuss/truckflow-user-importer/internal/database"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReplayFilter(t *testing.T) {
+	_, err := ReplayFilter("", "", "", false)
+	assert.Error(t, err)
+
+	filter, err := ReplayFilter("b63112e9", "", "", false)
+	assert.NoError(t, err)
+	assert.Equal(t, database.EventFilter{TransactionUUID: "b63112e9"}, filter)
+
+	filter, err = ReplayFilter("", "2025-01-27T22:00:00Z", "2025-02-01", true)
+	assert.NoError(t, err)
+	assert.Equal(t, time.Date(2025, 1, 27, 22, 0, 0, 0, time.UTC), filter.From)
+	assert.Equal(t, time.Date(2025, 2, 1, 0, 0, 0, 0, time.Local), filter.To)
+	assert.Equal(t, database.EventFailed, filter.Status)
+
+	_, err = ReplayFilter("", "yesterday", "", false)
+	assert.Error(t, err)
+}
+
+func TestReplayClaimsEvents(t *testing.T) {
+	ctx := context.Background()
+	pool, _ := testPool(t)
+	im := pool.Importer
+
+	// a worker is importing the event
+	ev, claimed, err := im.DB.QueueWebhookEvent("c7d4e1f0", []byte(importPayload), pool.Lease)
+	require.NoError(t, err)
+	require.True(t, claimed)
+
+	filter := database.EventFilter{TransactionUUID: "c7d4e1f0"}
+	results, err := im.Replay(ctx, filter, false)
+	require.NoError(t, err)
+	require.Len(t, results, 1)
+	assert.Equal(t, ErrEventClaimed.Error(), results[0].Error)
+	assert.Nil(t, results[0].Outcome)
+
+	require.NoError(t, im.DB.RetryWebhookEvent(ev.ID, errors.New("unavailable"), time.Hour))
+	results, err = im.Replay(ctx, filter, false)
+	require.NoError(t, err)
+	require.Len(t, results, 1)
+	require.NotNil(t, results[0].Outcome)
+	assert.Equal(t, "00001", results[0].Outcome.TiersCode)
+
+	got, err := im.DB.GetWebhookEvent(ev.ID)
+	require.NoError(t, err)
+	assert.Equal(t, database.EventDone, got.Status)
+}
@@ -0,0 +1,129 @@
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"path/filepath"
+
+	"github.com/clementnuss/truckflow-user-importer/internal/payrexx"
+	"github.com/clementnuss/truckflow-user-importer/internal/tracing"
+	"github.com/clementnuss/truckflow-user-importer/internal/truckflow"
+)
+
+// deactivate takes back the passes issued for a refunded or cancelled
+// transaction, and the tiers once it has no active pass left. Payrexx does not
+// tell which badges a partial refund is about, so it deactivates every pass of
+// the transaction as well.
+func (im *Importer) deactivate(ctx context.Context, transaction payrexx.Transaction) (_ *Outcome, err error) {
+	ctx, span := tracing.Start(ctx, "Deactivate", tracing.TransactionUUID.String(transaction.Uuid))
+	defer func() { tracing.End(span, err) }()
+
+	tx, clientHash, err := im.lockCustomer(ctx, transaction.Contact.Email)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	rec, err := tx.GetProcessedTransaction(clientHash, transaction.Uuid)
+	if err != nil {
+		return nil, fmt.Errorf("database error: %w", err)
+	}
+	if rec == nil {
+		slog.Info("ignoring reversal of a transaction that was never imported", "transaction", transaction.Uuid, "status", transaction.Status)
+		return &Outcome{Ignored: "reversal of a transaction that was never imported"}, nil
+	}
+	if rec.Reversed {
+		slog.Info("skipping already deactivated transaction", "transaction", transaction.Uuid, "status", transaction.Status)
+		return &Outcome{AlreadyProcessed: true}, nil
+	}
+
+	passes, err := tx.ActiveTransactionPasses(transaction.Uuid)
+	if err != nil {
+		return nil, fmt.Errorf("unable to retrieve the passes of the transaction: %w", err)
+	}
+	if err := tx.DeactivateTransactionPasses(transaction.Uuid); err != nil {
+		return nil, fmt.Errorf("unable to deactivate passes: %w", err)
+	}
+	if _, err := tx.MarkTransactionReversed(clientHash, transaction.Uuid); err != nil {
+		return nil, fmt.Errorf("unable to record reversed transaction: %w", err)
+	}
+
+	if len(passes) > 0 {
+		passImport := truckflow.PassImport{
+			Version: im.Config.Truckflow.Version,
+			Culture: im.Config.Truckflow.Culture,
+		}
+		for _, p := range passes {
+			passImport.Items = append(passImport.Items, truckflow.Pass{
+				ParkCode:    p.ParkCode,
+				Label:       p.ParkCode,
+				FlowType:    p.FlowType,
+				Plate:       p.Plate,
+				CompanyCode: p.CompanyCode,
+				TiersCode:   p.TiersCode,
+				ProductCode: p.ProductCode,
+				Active:      false,
+			})
+		}
+		jsonData, err := json.Marshal(passImport)
+		if err != nil {
+			return nil, fmt.Errorf("error marshaling JSON for pass: %w", err)
+		}
+
+		path := filepath.Join("importer/", fmt.Sprintf("pass_deactivation_%s_%s.json", rec.TiersCode, transaction.Uuid))
+		if err := tx.AddOutboxEntry(transaction.Uuid, path, jsonData); err != nil {
+			return nil, fmt.Errorf("unable to record pass json in outbox: %w", err)
+		}
+	}
+
+	remaining, err := tx.CountActivePasses(rec.TiersCode)
+	if err != nil {
+		return nil, fmt.Errorf("unable to count the active passes of the tiers: %w", err)
+	}
+	if remaining == 0 {
+		// the tiers is sent back as it was last imported, only inactive
+		content, err := tx.LatestOutboxContent(filepath.Join("importer/", fmt.Sprintf("tiers_import_%s", rec.TiersCode)))
+		if err != nil {
+			return nil, fmt.Errorf("unable to retrieve the tiers import: %w", err)
+		}
+
+		if content == nil {
+			slog.Warn("no tiers import found, tiers left active", "transaction", transaction.Uuid, "code", rec.TiersCode)
+		} else {
+			tiersImport := truckflow.TiersImport{}
+			if err := json.Unmarshal(content, &tiersImport); err != nil {
+				return nil, fmt.Errorf("unable to parse the tiers import: %w", err)
+			}
+			for i := range tiersImport.Items {
+				tiersImport.Items[i].Active = false
+			}
+			jsonData, err := json.Marshal(tiersImport)
+			if err != nil {
+				return nil, fmt.Errorf("error marshaling JSON for tier: %w", err)
+			}
+
+			path := filepath.Join("importer/", fmt.Sprintf("tiers_deactivation_%s_%s.json", rec.TiersCode, transaction.Uuid))
+			if err := tx.AddOutboxEntry(transaction.Uuid, path, jsonData); err != nil {
+				return nil, fmt.Errorf("unable to record tiers json in outbox: %w", err)
+			}
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("unable to commit deactivation: %w", err)
+	}
+
+	if err := im.flush(ctx, transaction.Uuid, 0); err != nil {
+		slog.Warn("deactivation files not uploaded yet", "transaction", transaction.Uuid, "error", err)
+	}
+
+	slog.Info("successfully deactivated a transaction", "transaction", transaction.Uuid, "status", transaction.Status, "code", rec.TiersCode, "passes", len(passes), "tiers_deactivated", remaining == 0)
+
+	out := Outcome{Deactivated: true, TiersCode: rec.TiersCode}
+	for _, p := range passes {
+		out.ParkCodes = append(out.ParkCodes, p.ParkCode)
+	}
+	return &out, nil
+}
@@ -0,0 +1,229 @@
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/clementnuss/truckflow-user-importer/internal/database"
+	"github.com/clementnuss/truckflow-user-importer/internal/failure"
+	"github.com/clementnuss/truckflow-user-importer/internal/payrexx"
+)
+
+// ValidationError is returned for transactions that cannot be imported as is.
+// Retrying them is pointless, they are parked for a review instead.
+type ValidationError struct {
+	Problems []string `json:"problems"`
+	err      error
+}
+
+func newValidationError(err error) *ValidationError {
+	ve := ValidationError{err: failure.NewPermanent(err)}
+	var joined interface{ Unwrap() []error }
+	if errors.As(err, &joined) {
+		for _, e := range joined.Unwrap() {
+			ve.Problems = append(ve.Problems, e.Error())
+		}
+	} else {
+		ve.Problems = []string{err.Error()}
+	}
+	return &ve
+}
+
+func (e *ValidationError) Error() string {
+	return "invalid transaction: " + strings.Join(e.Problems, "; ")
+}
+
+func (e *ValidationError) Unwrap() error {
+	return e.err
+}
+
+// Overrides are the corrections an operator makes to the order details of a
+// transaction under review. Nil fields keep the value given by the customer.
+type Overrides struct {
+	Plates     *string `json:"plates,omitempty"`
+	Company    *string `json:"company,omitempty"`
+	ClientType *string `json:"client_type,omitempty"`
+}
+
+func (o *Overrides) apply(f *payrexx.Fields) {
+	if o == nil {
+		return
+	}
+	if o.Plates != nil {
+		f.Plates = *o.Plates
+	}
+	if o.Company != nil {
+		f.Company = *o.Company
+	}
+	if o.ClientType != nil {
+		f.ClientType = *o.ClientType
+	}
+}
+
+// eventOverrides decodes the overrides stored with the event, if any.
+func eventOverrides(ev *database.WebhookEvent) (*Overrides, error) {
+	if len(ev.Overrides) == 0 {
+		return nil, nil
+	}
+	o := Overrides{}
+	if err := json.Unmarshal(ev.Overrides, &o); err != nil {
+		return nil, fmt.Errorf("invalid overrides for event %d: %w", ev.ID, err)
+	}
+	return &o, nil
+}
+
+// Review is a transaction waiting for an operator.
+type Review struct {
+	Event       int64     `json:"event"`
+	Transaction string    `json:"transaction"`
+	ReceivedAt  time.Time `json:"received_at"`
+	Email       string    `json:"email"`
+	// Fields are the order details as filled in by the customer.
+	Fields    payrexx.Fields `json:"fields"`
+	Overrides *Overrides     `json:"overrides,omitempty"`
+	// Problems are the validation errors left once the overrides are
+	// applied. An empty list means the review can be approved.
+	Problems []string `json:"problems"`
+}
+
+// ErrNotInReview is returned when editing or approving an event that is not
+// pending review.
+var ErrNotInReview = errors.New("event is not pending review")
+
+// Reviews lists the events pending review.
+func (im *Importer) Reviews(ctx context.Context) ([]Review, error) {
+	events, err := im.DB.ListWebhookEvents(database.EventFilter{Status: database.EventPendingReview})
+	if err != nil {
+		return nil, fmt.Errorf("unable to list webhook events: %w", err)
+	}
+
+	reviews := []Review{}
+	for _, ev := range events {
+		r, err := im.review(ctx, &ev)
+		if err != nil {
+			return nil, err
+		}
+		reviews = append(reviews, *r)
+	}
+	return reviews, nil
+}
+
+func (im *Importer) review(ctx context.Context, ev *database.WebhookEvent) (*Review, error) {
+	overrides, err := eventOverrides(ev)
+	if err != nil {
+		return nil, err
+	}
+	formData := Payload{}
+	if err := json.Unmarshal(ev.Payload, &formData); err != nil {
+		return nil, fmt.Errorf("invalid payload for event %d: %w", ev.ID, err)
+	}
+
+	r := Review{
+		Event:       ev.ID,
+		Transaction: ev.TransactionUUID,
+		ReceivedAt:  ev.ReceivedAt,
+		Email:       formData.Transaction.Contact.Email,
+		Fields:      formData.Transaction.CustomFields(),
+		Overrides:   overrides,
+		Problems:    []string{},
+	}
+
+	var ve *ValidationError
+	if _, _, err := im.parse(ctx, ev.Payload, overrides); errors.As(err, &ve) {
+		r.Problems = ve.Problems
+	} else if err != nil {
+		r.Problems = []string{err.Error()}
+	}
+	return &r, nil
+}
+
+// pendingReview returns the event if it is pending review.
+func (im *Importer) pendingReview(id int64) (*database.WebhookEvent, error) {
+	ev, err := im.DB.GetWebhookEvent(id)
+	if err != nil {
+		return nil, fmt.Errorf("unable to retrieve webhook event: %w", err)
+	}
+	if ev == nil || ev.Status != database.EventPendingReview {
+		return nil, ErrNotInReview
+	}
+	return ev, nil
+}
+
+// EditReview stores the overrides of an event pending review, replacing the
+// previous ones, and returns the review as it now stands.
+func (im *Importer) EditReview(ctx context.Context, id int64, overrides Overrides) (*Review, error) {
+	ev, err := im.pendingReview(id)
+	if err != nil {
+		return nil, err
+	}
+
+	ev.Overrides, err = json.Marshal(overrides)
+	if err != nil {
+		return nil, fmt.Errorf("error marshaling overrides: %w", err)
+	}
+	if err := im.DB.SetWebhookEventOverrides(id, ev.Overrides); err != nil {
+		return nil, fmt.Errorf("unable to store overrides: %w", err)
+	}
+
+	slog.Info("review edited", "event", id, "transaction", ev.TransactionUUID, "overrides", string(ev.Overrides))
+	return im.review(ctx, ev)
+}
+
+// ApproveReview imports an event pending review with its overrides. If it
+// still fails validation, it stays in review. Other permanent errors reject
+// it, while transient ones put it back in the queue, so that it is retried by
+// the Pool. The event is claimed first, so that it is approved once.
+func (im *Importer) ApproveReview(ctx context.Context, id int64) (*Outcome, error) {
+	ev, err := im.pendingReview(id)
+	if err != nil {
+		return nil, err
+	}
+	// checked before the claim, which only the import below releases
+	overrides, err := eventOverrides(ev)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel, err := im.claim(ctx, ev)
+	if errors.Is(err, ErrEventClaimed) {
+		return nil, ErrNotInReview
+	} else if err != nil {
+		return nil, err
+	}
+	defer cancel()
+
+	out, err := im.Import(ctx, ev.Payload, ImportOptions{Overrides: overrides})
+	var ve *ValidationError
+	switch {
+	case err == nil:
+		slog.Info("review approved", "event", id, "transaction", ev.TransactionUUID)
+		if err := im.DB.CompleteWebhookEvent(id); err != nil {
+			slog.Error("unable to update webhook event status", "event", id, "error", err)
+		}
+		return out, nil
+
+	case errors.As(err, &ve):
+		if err := im.DB.ReviewWebhookEvent(id, ve); err != nil {
+			slog.Error("unable to update webhook event status", "event", id, "error", err)
+		}
+		return nil, err
+
+	case ErrorKind(err) == failure.Permanent:
+		slog.Error("approved review rejected", "event", id, "transaction", ev.TransactionUUID, "error", err)
+		if err := im.DB.RejectWebhookEvent(id, err); err != nil {
+			slog.Error("unable to update webhook event status", "event", id, "error", err)
+		}
+		return nil, err
+
+	default:
+		slog.Warn("approved review will be retried", "event", id, "transaction", ev.TransactionUUID, "error", err)
+		if err := im.DB.RetryWebhookEvent(id, err, 0); err != nil {
+			slog.Error("unable to update webhook event status", "event", id, "error", err)
+		}
+		return nil, err
+	}
+}
@@ -0,0 +1,84 @@
+package webhook
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/clementnuss/truckflow-user-importer/internal/config"
+	"github.com/clementnuss/truckflow-user-importer/internal/database"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const reviewPayload = `{
+  "transaction": {
+    "uuid": "b63112e9",
+    "time": "2025-01-27 22:08:58",
+    "status": "confirmed",
+    "invoice": {
+      "products": [{"name": "Badge Ajoverts", "price": 2000, "quantity": 1}],
+      "custom_fields": [
+        {"name": "Type de client:", "value": "entreprise"},
+        {"name": "Numéros de plaques (séparés par des virgules)", "value": " , "}
+      ]
+    },
+    "contact": {"firstname": "Foo", "lastname": "Bar", "email": "some@email.ch"}
+  }
+}`
+
+func TestParseOverrides(t *testing.T) {
+	im := &Importer{Config: config.Default()}
+
+	_, _, err := im.parse(context.Background(), []byte(reviewPayload), nil)
+	var ve *ValidationError
+	require.True(t, errors.As(err, &ve))
+	assert.Equal(t, []string{"company client without company name", "no plate given"}, ve.Problems)
+
+	company, plates := "Foo SA", "vd 123"
+	tr, _, err := im.parse(context.Background(), []byte(reviewPayload), &Overrides{Company: &company, Plates: &plates})
+	require.NoError(t, err)
+	assert.Equal(t, "Foo SA", tr.Contact.Company)
+	assert.Equal(t, []string{"VD123"}, tr.Plates)
+}
+
+func TestApproveHandler(t *testing.T) {
+	pool, _ := testPool(t)
+	_, res := deliver(t, pool, reviewPayload)
+	require.Equal(t, database.EventPendingReview, res.Status)
+
+	approve := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/admin/reviews/"+strconv.FormatInt(res.Event, 10)+"/approve", nil)
+		req.SetPathValue("id", strconv.FormatInt(res.Event, 10))
+		rec := httptest.NewRecorder()
+		ApproveHandler(rec, req, pool.Importer)
+		return rec
+	}
+
+	rec := approve()
+	assert.Equal(t, http.StatusUnprocessableEntity, rec.Code)
+	assert.Contains(t, rec.Body.String(), "no plate given")
+
+	// invalid overrides leave the event in review
+	require.NoError(t, pool.Importer.DB.SetWebhookEventOverrides(res.Event, []byte("{")))
+	rec = approve()
+	assert.Equal(t, http.StatusInternalServerError, rec.Code)
+	ev, err := pool.Importer.DB.GetWebhookEvent(res.Event)
+	require.NoError(t, err)
+	assert.Equal(t, database.EventPendingReview, ev.Status)
+	require.NoError(t, pool.Importer.DB.SetWebhookEventOverrides(res.Event, nil))
+
+	company, plates := "Foo SA", "vd 123"
+	_, err = pool.Importer.EditReview(context.Background(), res.Event, Overrides{Company: &company, Plates: &plates})
+	require.NoError(t, err)
+	rec = approve()
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), `"tiers_code":"00001"`)
+
+	// the event is not in review anymore
+	rec = approve()
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+}
@@ -0,0 +1,60 @@
+package webhook
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/clementnuss/truckflow-user-importer/internal/config"
+	"github.com/clementnuss/truckflow-user-importer/internal/tracing"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func recordSpans(t *testing.T) *tracetest.InMemoryExporter {
+	exporter := tracetest.NewInMemoryExporter()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	previous := otel.GetTracerProvider()
+	otel.SetTracerProvider(tp)
+	t.Cleanup(func() { otel.SetTracerProvider(previous) })
+	return exporter
+}
+
+func TestParseSpans(t *testing.T) {
+	exporter := recordSpans(t)
+	im := &Importer{Config: config.Default()}
+
+	ctx, root := tracing.Start(context.Background(), "test")
+	_, _, err := im.parse(ctx, []byte(reviewPayload), nil)
+	root.End()
+	require.Error(t, err)
+
+	spans := exporter.GetSpans().Snapshots()
+	require.Len(t, spans, 3)
+	assert.Equal(t, "DecodePayload", spans[0].Name())
+	assert.Equal(t, "SanitizeFields", spans[1].Name())
+	assert.Contains(t, spans[1].Attributes(), tracing.TransactionUUID.String("b63112e9"))
+	assert.Equal(t, "Error", spans[1].Status().Code.String())
+	for _, s := range spans[:2] {
+		assert.Equal(t, root.SpanContext().TraceID(), s.Parent().TraceID())
+	}
+}
+
+func TestHandlerSpan(t *testing.T) {
+	exporter := recordSpans(t)
+	pool := NewPool(&Importer{Config: config.Default()})
+
+	req := httptest.NewRequest(http.MethodPost, "/webhook", strings.NewReader(reviewPayload))
+	rec := httptest.NewRecorder()
+	WebhookHandler(rec, req, pool, SignatureConfig{Secret: "secret"})
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+
+	spans := exporter.GetSpans().Snapshots()
+	require.Len(t, spans, 1)
+	assert.Equal(t, "POST /webhook", spans[0].Name())
+}
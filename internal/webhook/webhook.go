@@ -1,39 +1,71 @@
 package webhook
 
 import (
-	"bytes"
-	"context"
-	"database/sql"
 	"encoding/json"
-	"fmt"
+	"errors"
 	"io"
 	"log/slog"
 	"net/http"
-	"os"
-	"path/filepath"
-	"sync"
+	"strconv"
+	"time"
 
 	"github.com/clementnuss/truckflow-user-importer/internal/database"
+	"github.com/clementnuss/truckflow-user-importer/internal/failure"
+	"github.com/clementnuss/truckflow-user-importer/internal/metrics"
 	"github.com/clementnuss/truckflow-user-importer/internal/payrexx"
-	"github.com/clementnuss/truckflow-user-importer/internal/truckflow"
-	"github.com/minio/minio-go/v7"
+	"github.com/clementnuss/truckflow-user-importer/internal/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
-var mx sync.Mutex = sync.Mutex{}
+// SignatureConfig holds what is needed to authenticate Payrexx webhooks.
+type SignatureConfig struct {
+	// Secret is the API secret of the Payrexx instance.
+	Secret string
+	// Tolerance is the maximum accepted difference between the transaction
+	// time and now. Zero disables the check.
+	Tolerance time.Duration
+}
+
+// Response is the JSON body of the webhook answers.
+type Response struct {
+	// Status is either imported, deactivated, ignored, already_processed,
+	// pending_review, rejected, processing when the import is still
+	// running, pending when it will be retried, or unavailable. For a
+	// payload delivered again while its event is not pending anymore, it is
+	// the status of the event.
+	Status string `json:"status"`
+	Event  int64  `json:"event,omitempty"`
+	*Outcome
+	// Problems are the reasons why the transaction is pending review.
+	Problems []string `json:"problems,omitempty"`
+}
 
-func WebhookHandler(w http.ResponseWriter, r *http.Request, db *sql.DB, s3 *minio.Client) {
-	mx.Lock()
-	defer mx.Unlock()
+// WebhookHandler authenticates the webhook, stores its raw payload in the
+// webhook_events queue and starts importing it. The answer waits for the
+// import at most Pool.InlineTimeout, after which it is 202: the event is
+// queued and the Pool finishes it.
+//
+// Once the event is stored, import failures are acknowledged too: transient
+// ones, e.g. the database or the import sink being down, are answered with
+// 202 and retried by the Pool, never returned to Payrexx. Only failing to
+// store the event is answered with 503 and Retry-After. Error details are
+// logged, never sent back.
+//
+// With dryRun=true, nothing is stored and the Truckflow imports the payload
+// would produce are returned instead, see Importer.Preview.
+func WebhookHandler(w http.ResponseWriter, r *http.Request, pool *Pool, sig SignatureConfig) {
+	im := pool.Importer
+
+	ctx, span := tracing.Tracer().Start(r.Context(), "POST /webhook", trace.WithSpanKind(trace.SpanKindServer))
+	defer span.End()
+	r = r.WithContext(ctx)
 
 	if r.Method != http.MethodPost {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
-	formData := struct {
-		Transaction payrexx.Transaction `json:"transaction"`
-		Payout      payrexx.Payout      `json:"payout"`
-	}{}
 	body, err := io.ReadAll(r.Body)
 	if err != nil {
 		http.Error(w, "Error reading request body", http.StatusBadRequest)
@@ -41,163 +73,137 @@ func WebhookHandler(w http.ResponseWriter, r *http.Request, db *sql.DB, s3 *mini
 	}
 	defer r.Body.Close()
 
-	if err := json.Unmarshal(body, &formData); err != nil {
-		http.Error(w, "Error parsing JSON", http.StatusBadRequest)
-		return
-	}
-
-	if formData.Payout.Status != "" {
-		slog.Info("Ignoring payout data")
+	if err := payrexx.VerifySignature(body, r.Header.Get(payrexx.SignatureHeader), sig.Secret); err != nil {
+		slog.Warn("rejecting webhook", "remote", r.RemoteAddr, "error", err)
+		metrics.Webhooks.WithLabelValues("unauthorized").Inc()
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
 		return
 	}
 
-	if formData.Transaction.Invoice.ReferenceID != "" {
-		slog.Info("Ignoring invoice for weighing entries")
-		_, _ = w.Write([]byte("Ignoring invoice for weighing entries"))
-		return
-	}
-
-	transaction := formData.Transaction
-	err = transaction.SanitizeFields()
-
-	if transaction.Status != "confirmed" {
-		slog.Info("skipping uncompleted transaction", "status", transaction.Status)
-		_, _ = w.Write([]byte("Ignoring uncompleted transaction"))
+	// malformed payloads are recorded as rejected by the import below
+	_, decodeSpan := tracing.Start(ctx, "DecodePayload")
+	formData := Payload{}
+	err = json.Unmarshal(body, &formData)
+	tracing.End(decodeSpan, err)
+	malformed := err != nil
+	span.SetAttributes(tracing.TransactionUUID.String(formData.Transaction.Uuid))
+
+	// dry runs have no side effect, older payloads can be previewed as well
+	if r.URL.Query().Get("dryRun") == "true" {
+		preview, err := im.Preview(r.Context(), body)
+		var ve *ValidationError
+		switch {
+		case errors.As(err, &ve):
+			slog.Info("dry run failed", "transaction", formData.Transaction.Uuid, "error", err)
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusUnprocessableEntity)
+			_ = json.NewEncoder(w).Encode(ve)
+			return
+		case ErrorKind(err) == failure.Permanent:
+			slog.Info("dry run failed", "transaction", formData.Transaction.Uuid, "error", err)
+			http.Error(w, "Invalid payload", http.StatusUnprocessableEntity)
+			return
+		case err != nil:
+			slog.Error("dry run failed", "transaction", formData.Transaction.Uuid, "error", err)
+			unavailable(w, r, pool.MinBackoff)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(preview)
 		return
 	}
 
-	if err != nil {
-		slog.Error("unable to sanitize transaction fields", "error", err)
-		http.Error(w, "transaction error", http.StatusInternalServerError)
-		return
+	// reversals carry the time of the original payment
+	if !malformed && formData.Payout.Status == "" && !payrexx.IsReversal(formData.Transaction.Status) {
+		if err := payrexx.CheckFreshness(formData.Transaction.Time.Time, time.Now(), sig.Tolerance); err != nil {
+			slog.Warn("rejecting webhook", "transaction", formData.Transaction.Uuid, "time", formData.Transaction.Time.Time, "error", err)
+			metrics.Webhooks.WithLabelValues("stale").Inc()
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
 	}
 
-	clientHash := database.GenerateHash(transaction.Contact.Email)
-
-	processed, err := database.IsTransactionProcessed(db, clientHash, transaction.Uuid)
+	ev, claimed, err := im.DB.QueueWebhookEvent(formData.Transaction.Uuid, body, pool.Lease)
 	if err != nil {
-		http.Error(w, "Database error", http.StatusInternalServerError)
+		slog.Error("unable to store webhook event", "transaction", formData.Transaction.Uuid, "error", err)
+		unavailable(w, r, pool.MinBackoff)
 		return
 	}
-	if processed {
-		slog.Info("skipping already processed transaction.", "transaction", transaction.Uuid)
-		w.WriteHeader(http.StatusOK)
-		_, _ = w.Write([]byte("Transaction already processed"))
+	if !claimed {
+		slog.Info("webhook delivered again", "event", ev.ID, "transaction", ev.TransactionUUID, "status", ev.Status)
+		code := http.StatusOK
+		if ev.Status == database.EventProcessing {
+			code = http.StatusAccepted
+		}
+		respond(w, r, code, Response{Status: ev.Status, Event: ev.ID})
 		return
 	}
-
-	clientCounter, err := database.RetrieveCounter(db, "client")
-	if err != nil {
-		slog.Error("unable to retrieve the client counter from the DB", "error", err)
-		http.Error(w, "Database error - couldn't retrieve client counter", http.StatusInternalServerError)
+	span.SetAttributes(tracing.EventID.Int64(ev.ID))
+
+	// the import goes on in the background if it takes too long, so that
+	// Payrexx never waits on the database or the import sink
+	type result struct {
+		out *Outcome
+		err error
+	}
+	done := make(chan result, 1)
+	started := pool.goProcess(ctx, ev, func(out *Outcome, err error) {
+		done <- result{out, err}
+	})
+	if !started {
+		// shutting down, the lease of the event hands it out again
+		respond(w, r, http.StatusAccepted, Response{Status: database.EventPending, Event: ev.ID})
 		return
 	}
 
-	// tier creation
-	clientCounter += 1
-	tiers := truckflow.Tiers{
-		Type:         "Fournisseur",
-		Active:       true,
-		Address:      transaction.Contact.StreetAndNo,
-		ZIPCode:      transaction.Contact.ZIPCode,
-		City:         transaction.Contact.City,
-		Telephone:    transaction.Contact.Telephone,
-		Email:        transaction.Contact.Email,
-		Code:         fmt.Sprintf("%05d", clientCounter),
-		ProductCodes: "Dechets verts",
-	}
-
-	if transaction.Contact.ClientType == payrexx.Company {
-		tiers.Label = transaction.Contact.Company
-		tiers.ContactPerson = transaction.Contact.FirstName + " " + transaction.Contact.LastName
-	} else {
-		tiers.Label = transaction.Contact.FirstName + " " + transaction.Contact.LastName
-	}
-	truckflowImport := truckflow.TiersImport{
-		Version: "1.50",
-		Items:   []truckflow.Tiers{tiers},
-	}
-
-	jsonData, err := json.Marshal(truckflowImport)
-	if err != nil {
-		slog.Error("Error marshaling JSON", "transaction", transaction.Uuid, "error", err)
-		http.Error(w, "Error marshaling JSON for tier", http.StatusInternalServerError)
+	var res result
+	select {
+	case res = <-done:
+	case <-time.After(pool.InlineTimeout):
+		respond(w, r, http.StatusAccepted, Response{Status: database.EventProcessing, Event: ev.ID})
 		return
 	}
 
-	path := filepath.Join("importer/", fmt.Sprintf("tiers_import_%s.json", tiers.Code))
-	_, err = s3.PutObject(
-		context.Background(),
-		os.Getenv("S3_BUCKET"),
-		path,
-		bytes.NewReader(jsonData),
-		int64(len(jsonData)),
-		minio.PutObjectOptions{},
-	)
-	if err != nil {
-		slog.Error("unable to put json file on s3 bucket", "object", path, "error", err)
-		http.Error(w, fmt.Sprintf("unable to write tiers json. error: %v", err), http.StatusInternalServerError)
-		return
+	var ve *ValidationError
+	switch {
+	case res.err == nil:
+		span.SetAttributes(tracing.TiersCode.String(res.out.TiersCode))
+		respond(w, r, http.StatusOK, Response{Status: outcomeStatus(res.out), Event: ev.ID, Outcome: res.out})
+	case errors.As(res.err, &ve):
+		respond(w, r, http.StatusOK, Response{Status: database.EventPendingReview, Event: ev.ID, Problems: ve.Problems})
+	case ErrorKind(res.err) == failure.Permanent:
+		respond(w, r, http.StatusOK, Response{Status: database.EventRejected, Event: ev.ID})
+	default:
+		respond(w, r, http.StatusAccepted, Response{Status: database.EventPending, Event: ev.ID})
 	}
-	_ = database.SetCounter(db, "client", clientCounter)
+}
 
-	// pass creation
-	passImport := truckflow.PassImport{
-		Version: "1.50",
-		Culture: "fr",
-	}
-	passCounter, err := database.RetrieveCounter(db, "pass")
-	if err != nil {
-		slog.Error("unable to retrieve the pass counter from the DB", "error", err)
-		http.Error(w, "Database error - couldn't retrieve pass counter", http.StatusInternalServerError)
-		return
-	}
-	for _, pl := range transaction.Plates {
-		passCounter += 1
-		pa := truckflow.NewPass()
-		pa.Plate = pl
-		pa.ParkCode = fmt.Sprintf("NEW%05d", passCounter)
-		pa.Label = pa.ParkCode
-		pa.TiersCode = tiers.Code
-
-		switch transaction.Contact.ClientType {
-		case payrexx.Company:
-			pa.CompanyCode = "entreprises"
-		case payrexx.Individual:
-			pa.CompanyCode = "particuliers"
-		default:
-			slog.Error("unknown client type. assigning individual type", "transactionId", transaction.Uuid)
-			pa.CompanyCode = "particuliers"
-		}
-		passImport.Items = append(passImport.Items, *pa)
-	}
-	jsonData, err = json.Marshal(passImport)
-	if err != nil {
-		slog.Error("Error marshaling JSON", "transaction", transaction.Uuid, "error", err)
-		http.Error(w, "Error marshaling JSON for tier", http.StatusInternalServerError)
-		return
+func outcomeStatus(out *Outcome) string {
+	switch {
+	case out.Ignored != "":
+		return "ignored"
+	case out.AlreadyProcessed:
+		return "already_processed"
+	case out.Deactivated:
+		return "deactivated"
+	default:
+		return "imported"
 	}
+}
 
-	path = filepath.Join("importer/", fmt.Sprintf("pass_import_%s.json", tiers.Code))
-	_, err = s3.PutObject(
-		context.Background(),
-		os.Getenv("S3_BUCKET"),
-		path,
-		bytes.NewReader(jsonData),
-		int64(len(jsonData)),
-		minio.PutObjectOptions{},
+func respond(w http.ResponseWriter, r *http.Request, code int, res Response) {
+	metrics.Webhooks.WithLabelValues(res.Status).Inc()
+	trace.SpanFromContext(r.Context()).SetAttributes(
+		attribute.String("webhook.response.status", res.Status),
+		attribute.Int("http.response.status_code", code),
 	)
-	if err != nil {
-		slog.Error("unable to put json file on s3 bucket", "object", path, "error", err)
-		http.Error(w, fmt.Sprintf("unable to write pass json. error: %v", err), http.StatusInternalServerError)
-		return
-	}
-	_ = database.SetCounter(db, "pass", passCounter)
-
-	err = database.RecordProcessedTransaction(db, clientHash, transaction.Uuid)
-	if err != nil {
-		slog.Error("unable to record processed transaction.", "transaction", transaction.Uuid, "error", err, "code", tiers.Code, "label", tiers.Label)
-	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(res)
+}
 
-	slog.Info("successfully imported a new tier", "tiers", transaction.Uuid, "code", tiers.Code, "label", tiers.Label)
+// unavailable asks Payrexx to deliver the webhook again after delay.
+func unavailable(w http.ResponseWriter, r *http.Request, delay time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(delay.Seconds())))
+	respond(w, r, http.StatusServiceUnavailable, Response{Status: "unavailable"})
 }
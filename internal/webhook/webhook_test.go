@@ -0,0 +1,294 @@
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/clementnuss/truckflow-user-importer/internal/clienthash"
+	"github.com/clementnuss/truckflow-user-importer/internal/config"
+	"github.com/clementnuss/truckflow-user-importer/internal/database"
+	"github.com/clementnuss/truckflow-user-importer/internal/payrexx"
+	"github.com/clementnuss/truckflow-user-importer/internal/sink"
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const importPayload = `{
+  "transaction": {
+    "id": 1234,
+    "uuid": "c7d4e1f0",
+    "time": "2025-01-27 22:08:58",
+    "status": "confirmed",
+    "invoice": {
+      "products": [{"name": "Badge Ajoverts", "price": 2000, "quantity": 1}],
+      "custom_fields": [
+        {"name": "Type de client:", "value": "particulier"},
+        {"name": "Numéros de plaques (séparés par des virgules)", "value": "JU 12345"}
+      ]
+    },
+    "contact": {"firstname": "Foo", "lastname": "Bar", "email": "some@email.ch"}
+  }
+}`
+
+// fakeBucket is an S3 endpoint accepting every upload.
+type fakeBucket struct {
+	mu      sync.Mutex
+	objects []string
+}
+
+func (b *fakeBucket) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPut {
+		b.mu.Lock()
+		b.objects = append(b.objects, r.URL.Path)
+		b.mu.Unlock()
+	}
+	w.Header().Set("ETag", `"etag"`)
+}
+
+var testHasher = &clienthash.Hasher{Keys: []clienthash.Key{{ID: "k1", Secret: []byte("0123456789abcdef")}}}
+
+func testPool(t *testing.T) (*Pool, *fakeBucket) {
+	bucket := &fakeBucket{}
+	server := httptest.NewServer(bucket)
+	t.Cleanup(server.Close)
+
+	s3, err := minio.New(strings.TrimPrefix(server.URL, "http://"), &minio.Options{
+		Creds:  credentials.NewStaticV4("key", "secret", ""),
+		Region: "us-east-1",
+	})
+	require.NoError(t, err)
+
+	return NewPool(&Importer{
+		DB:     database.NewMemory(),
+		Sink:   &sink.S3{Client: s3, Bucket: "truckflow"},
+		Hasher: testHasher,
+		Config: config.Default(),
+	}), bucket
+}
+
+func deliver(t *testing.T, pool *Pool, payload string) (int, Response) {
+	req := httptest.NewRequest(http.MethodPost, "/webhook", strings.NewReader(payload))
+	req.Header.Set(payrexx.SignatureHeader, payrexx.Sign([]byte(payload), "secret"))
+	rec := httptest.NewRecorder()
+	WebhookHandler(rec, req, pool, SignatureConfig{Secret: "secret"})
+
+	res := Response{}
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &res), rec.Body.String())
+	return rec.Code, res
+}
+
+func TestWebhookHandler(t *testing.T) {
+	pool, bucket := testPool(t)
+
+	code, res := deliver(t, pool, importPayload)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "imported", res.Status)
+	require.NotNil(t, res.Outcome)
+	assert.Equal(t, "00001", res.TiersCode)
+	assert.Len(t, res.ParkCodes, 1)
+	assert.False(t, res.PendingUploads)
+	assert.ElementsMatch(t, []string{
+		"/truckflow/importer/tiers_import_00001.json",
+		"/truckflow/importer/pass_import_00001.json",
+	}, bucket.objects)
+
+	// Payrexx delivering the payload again
+	code, res = deliver(t, pool, importPayload)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, database.EventDone, res.Status)
+
+	code, res = deliver(t, pool, reviewPayload)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, database.EventPendingReview, res.Status)
+	assert.Equal(t, []string{"company client without company name", "no plate given"}, res.Problems)
+
+	customers, err := pool.Importer.DB.FindCustomers(testHasher.Hash("some@email.ch"), "")
+	require.NoError(t, err)
+	require.Len(t, customers, 1)
+	assert.Equal(t, "Foo Bar", customers[0].Label)
+}
+
+// blockingSink holds the uploads until released.
+type blockingSink struct {
+	sink.ImportSink
+	release chan struct{}
+}
+
+func (s *blockingSink) Put(ctx context.Context, name string, data []byte) error {
+	<-s.release
+	return s.ImportSink.Put(ctx, name, data)
+}
+
+func TestWebhookHandlerQueues(t *testing.T) {
+	pool, bucket := testPool(t)
+	pool.InlineTimeout = 10 * time.Millisecond
+	slow := &blockingSink{ImportSink: pool.Importer.Sink, release: make(chan struct{})}
+	pool.Importer.Sink = slow
+
+	code, res := deliver(t, pool, importPayload)
+	assert.Equal(t, http.StatusAccepted, code)
+	assert.Equal(t, database.EventProcessing, res.Status)
+	assert.Nil(t, res.Outcome)
+
+	// the import goes on once the handler answered
+	close(slow.release)
+	assert.Eventually(t, func() bool {
+		ev, err := pool.Importer.DB.GetWebhookEvent(res.Event)
+		return err == nil && ev.Status == database.EventDone
+	}, time.Second, 10*time.Millisecond)
+	bucket.mu.Lock()
+	assert.Len(t, bucket.objects, 2)
+	bucket.mu.Unlock()
+}
+
+func TestDryRun(t *testing.T) {
+	pool, _ := testPool(t)
+	dryRun := func(payload string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/webhook?dryRun=true", strings.NewReader(payload))
+		req.Header.Set(payrexx.SignatureHeader, payrexx.Sign([]byte(payload), "secret"))
+		rec := httptest.NewRecorder()
+		WebhookHandler(rec, req, pool, SignatureConfig{Secret: "secret"})
+		return rec
+	}
+
+	rec := dryRun(importPayload)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), "tiers_import_00001.json")
+
+	rec = dryRun(reviewPayload)
+	assert.Equal(t, http.StatusUnprocessableEntity, rec.Code)
+	assert.JSONEq(t, `{"problems": ["company client without company name", "no plate given"]}`, rec.Body.String())
+
+	// parsing errors are not sent back
+	rec = dryRun(`{"transaction": []}`)
+	assert.Equal(t, http.StatusUnprocessableEntity, rec.Code)
+	assert.Equal(t, "Invalid payload\n", rec.Body.String())
+}
+
+func TestCSVRowImportedByWebhook(t *testing.T) {
+	pool, _ := testPool(t)
+	im := pool.Importer
+	_, res := deliver(t, pool, importPayload)
+	require.Equal(t, "imported", res.Status)
+
+	uuids, err := im.TransactionUUIDs()
+	require.NoError(t, err)
+	assert.Equal(t, map[int]string{1234: "c7d4e1f0"}, uuids)
+
+	row := payrexx.CSVTransaction{
+		Id: "1234", FirstName: "Foo", LastName: "Bar", Status: "confirmed", Number: 1,
+		Email: "some@email.ch", PlateNumbers: "JU 12345",
+	}
+	tr, err := row.Transaction(payrexx.Product{Name: "Badge Ajoverts"}, im.IsBadge)
+	require.NoError(t, err)
+	tr.Uuid = uuids[tr.ID]
+	out, err := im.ImportTransaction(context.Background(), tr, ImportOptions{})
+	require.NoError(t, err)
+	assert.True(t, out.AlreadyProcessed)
+}
+
+// TestWebhookAndCSVAgree checks that a webhook payload and the matching row of
+// the Payrexx export shared with the payrexx tests produce the same Truckflow
+// imports.
+func TestWebhookAndCSVAgree(t *testing.T) {
+	f, err := os.Open(filepath.Join("..", "payrexx", "testdata", "export.csv"))
+	require.NoError(t, err)
+	defer f.Close()
+	rows, err := payrexx.ParseCSV(f)
+	require.NoError(t, err)
+
+	for _, tc := range []struct {
+		name    string
+		webhook string
+		// row is the # of the transaction in the export
+		row string
+	}{
+		{
+			name: "individual",
+			webhook: `{"transaction": {"id": 1234, "uuid": "a1b2c3d4", "time": "2025-01-27 22:08:58", "status": "confirmed",
+				"invoice": {"products": [{"name": "Badge Ajoverts", "quantity": 2}], "custom_fields": [
+					{"name": "Numéro client (optionnel)", "value": " 00014 "},
+					{"name": "Numéros de plaques (séparés par des virgules)", "value": "ju12345, Ju54321"},
+					{"name": "Type de client:", "value": "particulier"}]},
+				"contact": {"firstname": "Foo ", "lastname": "Bar", "street": "NotFar 2", "zip": "12345", "place": "Away",
+					"country": "CH", "phone": "+41123456789", "email": " some@email.ch"}}}`,
+			row: "1234",
+		},
+		{
+			name: "company",
+			webhook: `{"transaction": {"id": 1235, "uuid": "e5f6a7b8", "time": "2025-01-28 08:00:00", "status": "confirmed",
+				"invoice": {"products": [{"name": "Badge Ajoverts", "quantity": 1}], "custom_fields": [
+					{"name": "Numéros de plaques (séparés par des virgules)", "value": "VD1"},
+					{"name": "Entreprise", "value": "Qux SA "},
+					{"name": "Type de client:", "value": "entreprise"}]},
+				"contact": {"firstname": "Baz", "lastname": "Qux", "street": "Here 1", "zip": "2800", "place": "Delémont",
+					"country": "CH", "phone": "+41987654321", "email": "other@email.ch"}}}`,
+			row: "1235",
+		},
+		{
+			name: "missing plates",
+			webhook: `{"transaction": {"id": 1236, "uuid": "c9d0e1f2", "time": "2025-01-28 09:00:00", "status": "confirmed",
+				"invoice": {"products": [{"name": "Badge Ajoverts", "quantity": 2}], "custom_fields": [
+					{"name": "Numéros de plaques (séparés par des virgules)", "value": "ge 7890"}]},
+				"contact": {"firstname": "Ann", "lastname": "Onyme", "email": "ann@email.ch"}}}`,
+			row: "1236",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := context.Background()
+			newImporter := func() (*Importer, string) {
+				root := t.TempDir()
+				return &Importer{
+					DB:     database.NewMemory(),
+					Sink:   sink.NewDir(root),
+					Hasher: testHasher,
+					Config: config.Default(),
+				}, root
+			}
+
+			fromWebhook, webhookRoot := newImporter()
+			out, err := fromWebhook.Import(ctx, []byte(tc.webhook), ImportOptions{})
+			require.NoError(t, err)
+			require.False(t, out.PendingUploads)
+
+			i := slices.IndexFunc(rows, func(r payrexx.CSVTransaction) bool { return r.Id == tc.row })
+			require.NotEqual(t, -1, i, "no row %s in the export", tc.row)
+
+			fromCSV, csvRoot := newImporter()
+			tr, err := rows[i].Transaction(payrexx.Product{Name: "Badge Ajoverts"}, fromCSV.IsBadge)
+			require.NoError(t, err)
+			out, err = fromCSV.ImportTransaction(ctx, tr, ImportOptions{})
+			require.NoError(t, err)
+			require.False(t, out.PendingUploads)
+
+			webhookFiles := importFiles(t, webhookRoot)
+			assert.Len(t, webhookFiles, 2)
+			assert.Equal(t, webhookFiles, importFiles(t, csvRoot))
+		})
+	}
+}
+
+// importFiles returns the content of the import files written to root, by
+// name.
+func importFiles(t *testing.T, root string) map[string]string {
+	entries, err := os.ReadDir(filepath.Join(root, "importer"))
+	require.NoError(t, err)
+	files := map[string]string{}
+	for _, e := range entries {
+		content, err := os.ReadFile(filepath.Join(root, "importer", e.Name()))
+		require.NoError(t, err)
+		files[e.Name()] = string(content)
+	}
+	return files
+}
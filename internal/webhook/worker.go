@@ -0,0 +1,188 @@
+package webhook
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/clementnuss/truckflow-user-importer/internal/database"
+	"github.com/clementnuss/truckflow-user-importer/internal/failure"
+	"github.com/clementnuss/truckflow-user-importer/internal/metrics"
+	"github.com/clementnuss/truckflow-user-importer/internal/tracing"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// defaultLease is how long an event stays claimed, by the Pool or by a replay.
+const defaultLease = 5 * time.Minute
+
+// Pool processes the events stored in the webhook_events table.
+type Pool struct {
+	Importer *Importer
+	// Workers is the number of events processed concurrently.
+	Workers int
+	// MaxAttempts is the number of attempts after which an event is marked
+	// as failed.
+	MaxAttempts int
+	// PollInterval is the delay between two checks of an empty queue.
+	PollInterval time.Duration
+	// Lease is how long an event stays claimed by a worker before being
+	// handed out again, e.g. after a crash.
+	Lease time.Duration
+	// MinBackoff and MaxBackoff bound the delay between two attempts.
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+	// InlineTimeout is how long the webhook handler waits for the import of
+	// a new event before answering that it is queued.
+	InlineTimeout time.Duration
+
+	// inline are the imports started by the webhook handler, which Run
+	// waits for once stopped.
+	mu      sync.Mutex
+	stopped bool
+	inline  sync.WaitGroup
+}
+
+func NewPool(im *Importer) *Pool {
+	return &Pool{
+		Importer:      im,
+		Workers:       2,
+		MaxAttempts:   10,
+		PollInterval:  2 * time.Second,
+		Lease:         defaultLease,
+		MinBackoff:    10 * time.Second,
+		MaxBackoff:    time.Hour,
+		InlineTimeout: 5 * time.Second,
+	}
+}
+
+// Run starts the workers and blocks until ctx is cancelled and the events
+// being imported, by the workers or by the webhook handler, are handled. The
+// events still queued are left to the next start.
+func (p *Pool) Run(ctx context.Context) {
+	wg := sync.WaitGroup{}
+	for i := range p.Workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			p.work(ctx, i)
+		}()
+	}
+	wg.Wait()
+
+	p.mu.Lock()
+	p.stopped = true
+	p.mu.Unlock()
+	p.inline.Wait()
+}
+
+// goProcess imports a claimed event in the background, unless Run has
+// returned, and reports whether it did. done is called with the result.
+func (p *Pool) goProcess(ctx context.Context, ev *database.WebhookEvent, done func(*Outcome, error)) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.stopped {
+		return false
+	}
+	p.inline.Add(1)
+	go func() {
+		defer p.inline.Done()
+		done(p.process(ctx, ev))
+	}()
+	return true
+}
+
+func (p *Pool) work(ctx context.Context, worker int) {
+	for {
+		if ctx.Err() != nil {
+			return
+		}
+		ev, err := p.Importer.DB.ClaimWebhookEvent(p.Lease)
+		if err != nil {
+			slog.Error("unable to claim webhook event", "worker", worker, "error", err)
+		}
+
+		if ev == nil {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(p.PollInterval):
+				continue
+			}
+		}
+
+		_, _ = p.process(ctx, ev)
+	}
+}
+
+// process imports a claimed event and records the result: permanent failures
+// are parked for review or rejected, other ones are retried with a backoff
+// until MaxAttempts.
+func (p *Pool) process(ctx context.Context, ev *database.WebhookEvent) (*Outcome, error) {
+	// in-flight imports are not interrupted by a shutdown
+	ctx = context.WithoutCancel(ctx)
+	ctx, cancel := context.WithTimeout(ctx, p.Lease)
+	defer cancel()
+
+	ctx, span := tracing.Start(ctx, "ProcessEvent",
+		tracing.EventID.Int64(ev.ID),
+		tracing.TransactionUUID.String(ev.TransactionUUID),
+		attribute.Int("webhook.event.attempts", ev.Attempts),
+	)
+
+	overrides, err := eventOverrides(ev)
+	var out *Outcome
+	if err == nil {
+		out, err = p.Importer.Import(ctx, ev.Payload, ImportOptions{Overrides: overrides})
+	}
+
+	var updateErr error
+	var ve *ValidationError
+	switch {
+	case err == nil:
+		updateErr = p.Importer.DB.CompleteWebhookEvent(ev.ID)
+
+	case errors.As(err, &ve):
+		slog.Warn("webhook event needs a review", "event", ev.ID, "transaction", ev.TransactionUUID, "problems", ve.Problems)
+		metrics.ValidationRejects.Inc()
+		updateErr = p.Importer.DB.ReviewWebhookEvent(ev.ID, err)
+
+	case ErrorKind(err) == failure.Permanent:
+		slog.Error("webhook event rejected", "event", ev.ID, "transaction", ev.TransactionUUID, "error", err)
+		updateErr = p.Importer.DB.RejectWebhookEvent(ev.ID, err)
+
+	case ev.Attempts >= p.MaxAttempts:
+		slog.Error("webhook event failed", "event", ev.ID, "transaction", ev.TransactionUUID, "attempts", ev.Attempts, "error", err)
+		updateErr = p.Importer.DB.FailWebhookEvent(ev.ID, err)
+
+	default:
+		delay := p.retryDelay(ev)
+		slog.Warn("webhook event will be retried", "event", ev.ID, "transaction", ev.TransactionUUID, "attempts", ev.Attempts, "delay", delay, "error", err)
+		updateErr = p.Importer.DB.RetryWebhookEvent(ev.ID, err, delay)
+	}
+
+	if updateErr != nil {
+		slog.Error("unable to update webhook event status", "event", ev.ID, "error", updateErr)
+	}
+	if out != nil && out.TiersCode != "" {
+		span.SetAttributes(tracing.TiersCode.String(out.TiersCode))
+	}
+	tracing.End(span, err)
+	return out, err
+}
+
+// retryDelay is the delay before the next attempt of the event.
+func (p *Pool) retryDelay(ev *database.WebhookEvent) time.Duration {
+	return backoff(ev.Attempts, p.MinBackoff, p.MaxBackoff)
+}
+
+// backoff returns the delay before the next attempt, doubling after each
+// attempt.
+func backoff(attempts int, minDelay, maxDelay time.Duration) time.Duration {
+	d := minDelay
+	for i := 1; i < attempts && d < maxDelay; i++ {
+		d *= 2
+	}
+	return min(d, maxDelay)
+}
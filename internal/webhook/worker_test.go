@@ -0,0 +1,66 @@
+package webhook
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/clementnuss/truckflow-user-importer/internal/database"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBackoff(t *testing.T) {
+	minDelay, maxDelay := 10*time.Second, time.Minute
+
+	assert.Equal(t, 10*time.Second, backoff(1, minDelay, maxDelay))
+	assert.Equal(t, 20*time.Second, backoff(2, minDelay, maxDelay))
+	assert.Equal(t, 40*time.Second, backoff(3, minDelay, maxDelay))
+	assert.Equal(t, time.Minute, backoff(4, minDelay, maxDelay))
+	assert.Equal(t, time.Minute, backoff(100, minDelay, maxDelay))
+}
+
+func TestPoolStops(t *testing.T) {
+	pool, _ := testPool(t)
+	pool.InlineTimeout = 10 * time.Millisecond
+	slow := &blockingSink{ImportSink: pool.Importer.Sink, release: make(chan struct{})}
+	pool.Importer.Sink = slow
+
+	code, res := deliver(t, pool, importPayload)
+	require.Equal(t, http.StatusAccepted, code)
+
+	queued, _, err := pool.Importer.DB.QueueWebhookEvent("queued", []byte(reviewPayload), pool.Lease)
+	require.NoError(t, err)
+	require.NoError(t, pool.Importer.DB.RetryWebhookEvent(queued.ID, errors.New("test"), 0))
+
+	// a stopped pool claims nothing, but waits for the imports started by
+	// the handler
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	stopped := make(chan struct{})
+	go func() {
+		pool.Run(ctx)
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+		t.Fatal("Run returned before the inline import")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(slow.release)
+	<-stopped
+
+	ev, err := pool.Importer.DB.GetWebhookEvent(res.Event)
+	require.NoError(t, err)
+	assert.Equal(t, database.EventDone, ev.Status)
+	ev, err = pool.Importer.DB.GetWebhookEvent(queued.ID)
+	require.NoError(t, err)
+	assert.Equal(t, database.EventPending, ev.Status)
+
+	// the events delivered meanwhile are left to the lease
+	code, res = deliver(t, pool, reviewPayload)
+	assert.Equal(t, http.StatusAccepted, code)
+	assert.Equal(t, database.EventPending, res.Status)
+}
@@ -1,7 +1,6 @@
 package main
 
 import (
-	"bytes"
 	"context"
 	"errors"
 	"fmt"
@@ -9,13 +8,20 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"strconv"
 	"syscall"
 	"time"
 
+	"github.com/clementnuss/truckflow-user-importer/internal/clienthash"
+	"github.com/clementnuss/truckflow-user-importer/internal/config"
 	"github.com/clementnuss/truckflow-user-importer/internal/database"
+	"github.com/clementnuss/truckflow-user-importer/internal/health"
+	"github.com/clementnuss/truckflow-user-importer/internal/metrics"
+	"github.com/clementnuss/truckflow-user-importer/internal/retry"
+	"github.com/clementnuss/truckflow-user-importer/internal/sink"
+	"github.com/clementnuss/truckflow-user-importer/internal/tracing"
 	"github.com/clementnuss/truckflow-user-importer/internal/webhook"
-	"github.com/minio/minio-go/v7"
-	"github.com/minio/minio-go/v7/pkg/credentials"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 
 	_ "github.com/joho/godotenv/autoload"
 )
@@ -24,43 +30,206 @@ func main() {
 	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, syscall.SIGKILL, syscall.SIGINT)
 	defer stop()
 
+	cmd, args := "serve", []string{}
+	if len(os.Args) > 1 {
+		cmd, args = os.Args[1], os.Args[2:]
+	}
+
 	var err error
-	db, err := database.InitDB()
+	switch cmd {
+	case "serve":
+		err = serve(ctx, stop)
+	case "replay":
+		err = replay(ctx, args)
+	case "preview":
+		err = preview(ctx, args)
+	case "import-csv":
+		err = importCSV(ctx, args)
+	case "migrate":
+		err = migrate(ctx, args)
+	case "rehash":
+		err = rehash(ctx, args)
+	case "privacy":
+		err = privacy(ctx, args)
+	default:
+		err = fmt.Errorf("unknown command %q, expected serve, replay, preview, import-csv, migrate, rehash or privacy", cmd)
+	}
 	if err != nil {
-		slog.Error("database initialization error", "error", err)
-		return
+		slog.Error(cmd+" failed", "error", err)
+		os.Exit(1)
 	}
-	defer db.Close()
-	slog.Info("database successfully initialized")
+}
 
-	endpoint := os.Getenv("S3_ENDPOINT")
-	accessKeyID := os.Getenv("S3_ACCESS_KEY_ID")
-	secretAccessKey := os.Getenv("S3_SECRET_ACCESS_KEY")
-	bucket := os.Getenv("S3_BUCKET")
+// setup loads the configuration and connects to the database and to the
+// import sink.
+func setup(ctx context.Context) (database.Store, *webhook.Importer, error) {
+	db, importer, err := setupDB(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	policy, err := startupPolicy()
+	if err != nil {
+		db.Close()
+		return nil, nil, err
+	}
 
-	// Initialize minio client object.
-	minioClient, err := minio.New(endpoint, &minio.Options{
-		Creds:  credentials.NewStaticV4(accessKeyID, secretAccessKey, ""),
-		Secure: true,
+	importSink, err := sink.Open()
+	if err != nil {
+		db.Close()
+		return nil, nil, err
+	}
+	err = retry.Do(ctx, policy, "import sink", func(ctx context.Context) error {
+		return sink.Probe(ctx, importSink)
 	})
 	if err != nil {
-		slog.Error("database initialization error", "error", err)
-		return
+		db.Close()
+		return nil, nil, err
 	}
 
-	testData := []byte(fmt.Sprintf("test string %v", time.Now()))
-	_, err = minioClient.PutObject(ctx, bucket, "importer/test", bytes.NewReader(testData), int64(len(testData)), minio.PutObjectOptions{})
+	slog.Info("import sink ready", "sink", importSink)
+
+	importer.Sink = importSink
+	return db, importer, nil
+}
+
+// setupDB loads the configuration and connects to the database only, for
+// commands that never write to the import sink. The pending migrations are
+// applied.
+func setupDB(ctx context.Context) (database.Store, *webhook.Importer, error) {
+	return openDB(ctx, database.InitDB)
+}
+
+// setupReadOnlyDB is setupDB for the commands without side effects: the
+// migrations are not applied, and the command fails if any is pending.
+func setupReadOnlyDB(ctx context.Context) (database.Store, *webhook.Importer, error) {
+	db, importer, err := openDB(ctx, func(ctx context.Context) (database.Store, error) {
+		db, err := database.Open()
+		if err != nil {
+			return nil, err
+		}
+		if err := db.Ping(ctx); err != nil {
+			db.Close()
+			return nil, err
+		}
+		return db, nil
+	})
 	if err != nil {
-		slog.Error("unable to create test file on S3 endpoint", "error", err)
-		return
+		return nil, nil, err
 	}
-	err = minioClient.RemoveObject(ctx, bucket, "importer/test", minio.RemoveObjectOptions{})
+	if err := database.CheckSchema(ctx, db); err != nil {
+		db.Close()
+		return nil, nil, err
+	}
+	return db, importer, nil
+}
+
+// openDB loads the configuration and waits for the database, opened with
+// open.
+func openDB(ctx context.Context, open func(ctx context.Context) (database.Store, error)) (database.Store, *webhook.Importer, error) {
+	cfg, err := config.Load(os.Getenv("CONFIG_FILE"))
+	if err != nil {
+		return nil, nil, err
+	}
+	hasher, err := clienthash.FromEnv()
 	if err != nil {
-		slog.Error("unable to delete test file on S3 endpoint", "error", err)
-		return
+		return nil, nil, err
+	}
+	if !hasher.Keyed() {
+		slog.Warn("CLIENT_HASH_KEYS is not set, customers are identified by the legacy unkeyed hash of their email")
 	}
+	policy, err := startupPolicy()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var db database.Store
+	err = retry.Do(ctx, policy, "database", func(ctx context.Context) error {
+		db, err = open(ctx)
+		return err
+	})
+	if err != nil {
+		return nil, nil, fmt.Errorf("database initialization error: %v", err)
+	}
+	slog.Info("database successfully initialized")
 
-	slog.Info("minio s3 client started")
+	return db, &webhook.Importer{DB: db, Hasher: hasher, Config: cfg}, nil
+}
+
+// startupPolicy tells how long to wait for the database and the import sink at
+// startup, from STARTUP_RETRY_TIMEOUT and STARTUP_RETRY_MAX_DELAY.
+func startupPolicy() (retry.Policy, error) {
+	policy := retry.DefaultPolicy()
+	if v := os.Getenv("STARTUP_RETRY_TIMEOUT"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return policy, fmt.Errorf("invalid STARTUP_RETRY_TIMEOUT %q: %v", v, err)
+		}
+		policy.Timeout = d
+	}
+	if v := os.Getenv("STARTUP_RETRY_MAX_DELAY"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			return policy, fmt.Errorf("invalid STARTUP_RETRY_MAX_DELAY %q", v)
+		}
+		policy.MaxDelay = d
+		policy.MinDelay = min(policy.MinDelay, d)
+	}
+	return policy, nil
+}
+
+func serve(ctx context.Context, stop context.CancelFunc) error {
+	db, importer, err := setup(ctx)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	sig := webhook.SignatureConfig{
+		Secret:    os.Getenv("PAYREXX_API_SECRET"),
+		Tolerance: 24 * time.Hour,
+	}
+	if sig.Secret == "" {
+		return errors.New("PAYREXX_API_SECRET must be set to verify webhook signatures")
+	}
+	if v := os.Getenv("WEBHOOK_TOLERANCE"); v != "" {
+		sig.Tolerance, err = time.ParseDuration(v)
+		if err != nil {
+			return fmt.Errorf("invalid WEBHOOK_TOLERANCE %q: %v", v, err)
+		}
+	}
+
+	shutdownTracing, err := tracing.Setup(ctx)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := shutdownTracing(context.Background()); err != nil {
+			slog.Error("unable to flush traces", "error", err)
+		}
+	}()
+
+	pool := webhook.NewPool(importer)
+	if v := os.Getenv("WEBHOOK_WORKERS"); v != "" {
+		pool.Workers, err = strconv.Atoi(v)
+		if err != nil || pool.Workers < 1 {
+			return fmt.Errorf("invalid WEBHOOK_WORKERS %q", v)
+		}
+	}
+	if v := os.Getenv("WEBHOOK_MAX_ATTEMPTS"); v != "" {
+		pool.MaxAttempts, err = strconv.Atoi(v)
+		if err != nil || pool.MaxAttempts < 1 {
+			return fmt.Errorf("invalid WEBHOOK_MAX_ATTEMPTS %q", v)
+		}
+	}
+
+	poolDone := make(chan struct{})
+	go func() {
+		pool.Run(ctx)
+		close(poolDone)
+	}()
+	slog.Info("webhook workers started", "workers", pool.Workers)
+
+	go webhook.NewReconciler(importer).Run(ctx)
 
 	port := ":9000"
 	server := http.Server{
@@ -68,9 +237,42 @@ func main() {
 	}
 
 	http.HandleFunc("/webhook", func(w http.ResponseWriter, r *http.Request) {
-		webhook.WebhookHandler(w, r, db, minioClient)
+		webhook.WebhookHandler(w, r, pool, sig)
 	})
 
+	metrics.RegisterCounters(func(name string) (int, error) {
+		return db.PeekCounter(name)
+	}, "client", "pass")
+	http.Handle("/metrics", promhttp.Handler())
+
+	// sink checks are cached to not hammer the S3 or SFTP server with every
+	// probe
+	checker := health.NewChecker()
+	checker.Add("database", health.DatabaseCheck(db))
+	checker.Add("sink", health.Cached(importer.Sink.Check, 30*time.Second))
+	http.HandleFunc("/healthz", checker.Live)
+	http.HandleFunc("/readyz", checker.Ready)
+
+	adminToken := os.Getenv("ADMIN_TOKEN")
+	if adminToken == "" {
+		slog.Warn("ADMIN_TOKEN is not set, admin endpoints are disabled")
+	}
+	http.HandleFunc("/admin/replay", webhook.RequireToken(adminToken, func(w http.ResponseWriter, r *http.Request) {
+		webhook.ReplayHandler(w, r, importer)
+	}))
+	http.HandleFunc("/admin/customers", webhook.RequireToken(adminToken, func(w http.ResponseWriter, r *http.Request) {
+		webhook.CustomersHandler(w, r, db, importer.Hasher)
+	}))
+	http.HandleFunc("/admin/reviews", webhook.RequireToken(adminToken, func(w http.ResponseWriter, r *http.Request) {
+		webhook.ReviewsHandler(w, r, importer)
+	}))
+	http.HandleFunc("/admin/reviews/{id}", webhook.RequireToken(adminToken, func(w http.ResponseWriter, r *http.Request) {
+		webhook.ReviewHandler(w, r, importer)
+	}))
+	http.HandleFunc("/admin/reviews/{id}/approve", webhook.RequireToken(adminToken, func(w http.ResponseWriter, r *http.Request) {
+		webhook.ApproveHandler(w, r, importer)
+	}))
+
 	slog.Info("webhook server starting", "port", port)
 	go func() {
 		err := server.ListenAndServe()
@@ -83,9 +285,10 @@ func main() {
 	<-ctx.Done()
 
 	if err := server.Shutdown(context.Background()); err != nil && !errors.Is(err, http.ErrServerClosed) {
-		slog.Error("could not shutdown http server properly", "error", err)
-		os.Exit(1)
+		return fmt.Errorf("could not shutdown http server properly: %v", err)
 	}
+	<-poolDone
 
 	slog.Info("graceful shutdown completed")
+	return nil
 }
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/clementnuss/truckflow-user-importer/internal/database"
+)
+
+// migrate shows the state of the database migrations, or applies the pending
+// ones.
+func migrate(ctx context.Context, args []string) error {
+	if len(args) != 1 || (args[0] != "status" && args[0] != "up") {
+		return errors.New("usage: migrate status|up")
+	}
+
+	db, err := database.Open()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	if args[0] == "up" {
+		if err := db.Migrate(ctx); err != nil {
+			return err
+		}
+	}
+
+	statuses, err := db.MigrationStatuses(ctx)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "VERSION\tNAME\tAPPLIED AT")
+	pending := 0
+	for _, s := range statuses {
+		applied := "pending"
+		if !s.AppliedAt.IsZero() {
+			applied = s.AppliedAt.Format(time.DateTime)
+		} else {
+			pending += 1
+		}
+		fmt.Fprintf(w, "%04d\t%s\t%s\n", s.Version, s.Name, applied)
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	fmt.Printf("%d migrations, %d pending\n", len(statuses), pending)
+	return nil
+}
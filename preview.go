@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+)
+
+// preview prints the Truckflow imports a webhook payload would produce,
+// without importing it.
+func preview(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("preview", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: preview [payload.json]\n\nReads the webhook payload from the file, or from stdin when omitted.")
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	in := os.Stdin
+	if fs.NArg() > 0 {
+		f, err := os.Open(fs.Arg(0))
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		in = f
+	}
+	body, err := io.ReadAll(in)
+	if err != nil {
+		return fmt.Errorf("unable to read payload: %v", err)
+	}
+
+	db, importer, err := setupReadOnlyDB(ctx)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	p, err := importer.Preview(ctx, body)
+	if err != nil {
+		return err
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(p)
+}
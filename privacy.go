@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+)
+
+// privacy answers the data access and erasure requests of customers.
+func privacy(ctx context.Context, args []string) error {
+	usage := errors.New("usage: privacy export|erase -email address -operator name [-reason text]")
+	if len(args) == 0 || (args[0] != "export" && args[0] != "erase") {
+		return usage
+	}
+
+	fs := flag.NewFlagSet("privacy "+args[0], flag.ContinueOnError)
+	email := fs.String("email", "", "email of the customer")
+	operator := fs.String("operator", os.Getenv("USER"), "name of the person handling the request, kept in the audit trail")
+	reason := fs.String("reason", "", "reference of the request, kept in the audit trail")
+	out := fs.String("out", "", "file to write the export to (default: standard output)")
+	confirm := fs.Bool("yes", false, "confirm the erasure, which cannot be undone")
+	if err := fs.Parse(args[1:]); err != nil {
+		return err
+	}
+	if *email == "" || fs.NArg() > 0 {
+		return usage
+	}
+
+	if args[0] == "export" {
+		db, importer, err := setup(ctx)
+		if err != nil {
+			return err
+		}
+		defer db.Close()
+
+		bundle, err := importer.ExportCustomer(ctx, *email, *operator, *reason)
+		if err != nil {
+			return err
+		}
+		data, err := json.MarshalIndent(bundle, "", "  ")
+		if err != nil {
+			return err
+		}
+		if *out == "" {
+			_, err = fmt.Println(string(data))
+			return err
+		}
+		return os.WriteFile(*out, append(data, '\n'), 0o600)
+	}
+
+	if !*confirm {
+		return errors.New("the erasure cannot be undone, run privacy export first and confirm with -yes")
+	}
+	db, importer, err := setup(ctx)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	res, err := importer.EraseCustomer(ctx, *email, *operator, *reason)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("erased tiers %v: %d transactions, %d passes, %d import files, %d webhook events\n",
+		res.TiersCodes, res.Transactions, res.Passes, res.ImportFiles, res.WebhookEvents)
+	if res.PendingUploads {
+		fmt.Println("the deactivation files are not uploaded yet, the reconciler of the server will upload them")
+	}
+	for _, e := range res.Errors {
+		fmt.Printf("unable to delete %s\n", e)
+	}
+	if len(res.Errors) > 0 {
+		return fmt.Errorf("%d webhook events left, run the erasure again", len(res.Errors))
+	}
+	return nil
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// rehash rewrites the client hashes recorded with a previous key or with the
+// legacy hash with the current key of CLIENT_HASH_KEYS.
+func rehash(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("rehash", flag.ContinueOnError)
+	emailsFile := fs.String("emails", "", "file listing other emails to rewrite the hashes of, one per line, e.g. those of a CSV import")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	var emails []string
+	if *emailsFile != "" {
+		f, err := os.Open(*emailsFile)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			if email := strings.TrimSpace(scanner.Text()); email != "" {
+				emails = append(emails, email)
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			return fmt.Errorf("unable to read %s: %v", *emailsFile, err)
+		}
+	}
+
+	db, importer, err := setupDB(ctx)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	res, err := importer.Rehash(ctx, emails)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%d emails, %d client hashes rewritten, %d left with a previous key\n", res.Emails, res.Rewritten, res.Stale)
+	if res.Stale > 0 {
+		fmt.Println("the emails of the hashes left are unknown, pass them with -emails before dropping the previous keys")
+	}
+	return nil
+}
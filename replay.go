@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+
+	"github.com/clementnuss/truckflow-user-importer/internal/webhook"
+)
+
+// replay re-runs the import pipeline for stored webhook events.
+func replay(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("replay", flag.ContinueOnError)
+	transaction := fs.String("transaction", "", "replay the events of this transaction UUID")
+	from := fs.String("from", "", "replay the events received at or after this time (RFC 3339 or YYYY-MM-DD)")
+	to := fs.String("to", "", "replay the events received before this time (RFC 3339 or YYYY-MM-DD)")
+	failed := fs.Bool("failed", false, "replay the events in failed state")
+	force := fs.Bool("force", false, "import transactions even if they were already processed")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	filter, err := webhook.ReplayFilter(*transaction, *from, *to, *failed)
+	if err != nil {
+		return err
+	}
+
+	db, importer, err := setup(ctx)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	results, err := importer.Replay(ctx, filter, *force)
+	if err != nil {
+		return err
+	}
+
+	failures := 0
+	for _, res := range results {
+		if res.Error != "" {
+			failures += 1
+			fmt.Printf("event %d (transaction %s): %s\n", res.Event, res.Transaction, res.Error)
+		} else {
+			fmt.Printf("event %d (transaction %s): ok\n", res.Event, res.Transaction)
+		}
+	}
+	fmt.Printf("%d events replayed, %d failed\n", len(results), failures)
+
+	if failures > 0 {
+		return fmt.Errorf("%d events failed", failures)
+	}
+	return nil
+}